@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// folder artifacts (packaging NONE) can hold thousands of files, only link
+// the first few
+const maxArtifactFiles = 20
+
+type artifactLink struct {
+	identifier string
+	name       string
+	size       int64
+	url        string
+}
+
+// ARTIFACT_LINK_PROJECTS is a comma separated list of CodeBuild projects
+// whose artifacts get download links in the PR comment, or * for all
+func getArtifactProjects() map[string]bool {
+	projects := make(map[string]bool)
+
+	for _, name := range strings.Split(os.Getenv("ARTIFACT_LINK_PROJECTS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			projects[name] = true
+		}
+	}
+
+	return projects
+}
+
+// ARTIFACT_LINK_EXPIRY is how long artifact links last, SigV4 caps it at
+// 7 days. Presigned URLs stop working when the credentials that signed them
+// expire, and the temporary credentials of a Lambda role last a few hours at
+// most, so longer expiries need links signed with long-lived credentials.
+func getArtifactLinkExpiry() time.Duration {
+	expiry, err := time.ParseDuration(os.Getenv("ARTIFACT_LINK_EXPIRY"))
+	if err != nil || expiry <= 0 || expiry > 7*24*time.Hour {
+		expiry = time.Hour
+	}
+
+	return expiry
+}
+
+func artifactLinksEnabled(projectName string) bool {
+	return artifactProjects["*"] || artifactProjects[projectName]
+}
+
+// artifact locations look like "arn:aws:s3:::bucket/path/to/artifact.zip"
+func parseArtifactLocation(location string) (bucket, key string, err error) {
+	const prefix = "arn:aws:s3:::"
+	if !strings.HasPrefix(location, prefix) {
+		return "", "", fmt.Errorf("unexpected artifact location %s", location)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(location, prefix), "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("unexpected artifact location %s", location)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// every primary and secondary artifact of a build
+func buildArtifacts(build *codebuild.Build) []*codebuild.BuildArtifacts {
+	artifacts := build.SecondaryArtifacts
+	if build.Artifacts != nil {
+		artifacts = append([]*codebuild.BuildArtifacts{build.Artifacts}, artifacts...)
+	}
+
+	return artifacts
+}
+
+func listBuildArtifacts(ctx context.Context, svc *s3.S3, build *codebuild.Build,
+	expiry time.Duration) ([]artifactLink, error) {
+	var links []artifactLink
+
+	for _, artifact := range buildArtifacts(build) {
+		location := aws.StringValue(artifact.Location)
+		if location == "" {
+			// projects with NO_ARTIFACTS still report an empty artifact
+			continue
+		}
+
+		bucket, key, err := parseArtifactLocation(location)
+		if err != nil {
+			return links, err
+		}
+
+		// zipped artifacts are a single object, unpackaged ones are a folder.
+		// Only zipped artifacts have a checksum.
+		prefix := key + "/"
+		if aws.StringValue(artifact.Sha256sum) != "" {
+			prefix = key
+		}
+
+		list, err := svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(bucket),
+			Prefix:  aws.String(prefix),
+			MaxKeys: aws.Int64(maxArtifactFiles),
+		})
+		if err != nil {
+			return links, fmt.Errorf("unable to list artifact %s: %s", location, err)
+		}
+
+		for _, object := range list.Contents {
+			if prefix == key && aws.StringValue(object.Key) != key {
+				// another artifact whose name starts with this one
+				continue
+			}
+
+			req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    object.Key,
+			})
+
+			url, err := req.Presign(expiry)
+			if err != nil {
+				return links, fmt.Errorf("unable to presign artifact %s: %s", aws.StringValue(object.Key), err)
+			}
+
+			links = append(links, artifactLink{
+				identifier: aws.StringValue(artifact.ArtifactIdentifier),
+				name:       path.Base(aws.StringValue(object.Key)),
+				size:       aws.Int64Value(object.Size),
+				url:        url,
+			})
+		}
+	}
+
+	return links, nil
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatArtifacts(links []artifactLink, expiry time.Duration) string {
+	if len(links) == 0 {
+		return ""
+	}
+
+	var table strings.Builder
+
+	fmt.Fprintf(&table, "**Artifacts** (links expire after %s)\n\n", expiry)
+	table.WriteString("| Artifact | File | Size |\n")
+	table.WriteString("|----------|------|------|\n")
+
+	for _, link := range links {
+		identifier := link.identifier
+		if identifier == "" {
+			identifier = "primary"
+		}
+
+		fmt.Fprintf(&table, "| %s | [%s](%s) | %s |\n",
+			escapeTableCell(identifier), escapeTableCell(link.name), link.url, formatSize(link.size))
+	}
+
+	return table.String()
+}
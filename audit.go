@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditEntry records one change the monitor made on GitHub, and which event
+// made it
+type auditEntry struct {
+	Time          time.Time `json:"time"`
+	EventID       string    `json:"event_id,omitempty"`
+	Action        string    `json:"action"`
+	Method        string    `json:"method"`
+	Host          string    `json:"host"`
+	Repo          string    `json:"repo,omitempty"`
+	Commit        string    `json:"commit,omitempty"`
+	PR            int       `json:"pr,omitempty"`
+	Comment       string    `json:"comment,omitempty"`
+	PayloadSHA256 string    `json:"payload_sha256"`
+	StatusCode    int       `json:"status_code"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type auditFilter struct {
+	repo   string
+	commit string
+	since  time.Time
+}
+
+func (f auditFilter) matches(entry auditEntry) bool {
+	return (f.repo == "" || strings.EqualFold(f.repo, entry.Repo)) &&
+		(f.commit == "" || strings.HasPrefix(entry.Commit, f.commit)) &&
+		!entry.Time.Before(f.since)
+}
+
+// an auditSink stores entries in batches and can find them again
+type auditSink interface {
+	write(ctx context.Context, entries []auditEntry) error
+	query(ctx context.Context, filter auditFilter) ([]auditEntry, error)
+}
+
+// auditLogger buffers entries until the end of an invocation, so sinks like
+// S3 write a single object per batch
+type auditLogger struct {
+	sink    auditSink
+	mu      sync.Mutex
+	pending []auditEntry
+}
+
+// nil when AUDIT_LOG is not set, which turns auditing off
+var auditLog *auditLogger
+
+func (a *auditLogger) record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	a.pending = append(a.pending, entry)
+	a.mu.Unlock()
+}
+
+// flush writes the pending entries in what is left of the deadline of ctx,
+// including the reserve kept for it
+func (a *auditLogger) flush(ctx context.Context) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := callContext(withReserve(ctx))
+	defer cancel()
+
+	err := a.sink.write(ctx, pending)
+	if err != nil {
+		// the changes are already made, losing the record is not worth failing
+		// the event and making them again
+		log.Printf("Unable to write %d audit entries: %s", len(pending), err)
+	}
+}
+
+type auditContextKey struct{}
+
+// what the audit entries of a GitHub call are attributed to
+type auditContext struct {
+	eventID string
+	repo    string
+	commit  string
+}
+
+func withAuditEvent(ctx context.Context, eventID string) context.Context {
+	return context.WithValue(ctx, auditContextKey{}, auditContext{eventID: eventID})
+}
+
+// comment edits and deletes only name the comment, and GraphQL mutations only
+// a node, the repo and commit being worked on come from the context
+func withAuditCommit(ctx context.Context, owner, repo, commit string) context.Context {
+	audit, _ := ctx.Value(auditContextKey{}).(auditContext)
+	audit.repo = owner + "/" + repo
+	audit.commit = commit
+
+	return context.WithValue(ctx, auditContextKey{}, audit)
+}
+
+type auditRoute struct {
+	method  string
+	pattern *regexp.Regexp
+	action  string
+	target  string // what the second group of pattern is
+}
+
+// the REST calls the monitor makes that change something, pipeline overviews
+// are commit comments or PR comments
+var auditRoutes = []auditRoute{
+	{"POST", regexp.MustCompile(`repos/([^/]+/[^/]+)/statuses/(\w+)$`), "status.create", "commit"},
+	{"POST", regexp.MustCompile(`repos/([^/]+/[^/]+)/issues/(\d+)/comments$`), "comment.create", "pr"},
+	{"PATCH", regexp.MustCompile(`repos/([^/]+/[^/]+)/issues/comments/(\d+)$`), "comment.edit", "comment"},
+	{"DELETE", regexp.MustCompile(`repos/([^/]+/[^/]+)/issues/comments/(\d+)$`), "comment.delete", "comment"},
+	{"POST", regexp.MustCompile(`repos/([^/]+/[^/]+)/commits/(\w+)/comments$`), "commit_comment.create", "commit"},
+	{"PATCH", regexp.MustCompile(`repos/([^/]+/[^/]+)/comments/(\d+)$`), "commit_comment.edit", "comment"},
+}
+
+// describe a request as an audit entry, ok is false for reads and for calls
+// that don't change a repository, like minting app tokens
+func auditEntryFor(req *http.Request, body []byte) (auditEntry, bool) {
+	entry := auditEntry{Method: req.Method, Host: req.URL.Host}
+
+	if req.Method == "POST" && strings.HasSuffix(req.URL.Path, "/graphql") {
+		var gql graphQLRequest
+		if json.Unmarshal(body, &gql) != nil || !strings.HasPrefix(strings.TrimSpace(gql.Query), "mutation") {
+			return entry, false
+		}
+
+		entry.Action = "graphql.mutation"
+		if strings.Contains(gql.Query, "minimizeComment") {
+			entry.Action = "comment.minimize"
+		}
+
+		entry.Comment, _ = gql.Variables["id"].(string)
+
+		return entry, true
+	}
+
+	for _, route := range auditRoutes {
+		if req.Method != route.method {
+			continue
+		}
+
+		match := route.pattern.FindStringSubmatch(req.URL.Path)
+		if match == nil {
+			continue
+		}
+
+		entry.Action = route.action
+		entry.Repo = match[1]
+
+		switch route.target {
+		case "commit":
+			entry.Commit = match[2]
+		case "pr":
+			entry.PR, _ = strconv.Atoi(match[2])
+		case "comment":
+			entry.Comment = match[2]
+		}
+
+		return entry, true
+	}
+
+	return entry, false
+}
+
+// auditTransport records every mutating call made through a GitHub client
+type auditTransport struct {
+	base http.RoundTripper
+	log  *auditLogger
+}
+
+func (t auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.log == nil || req.Method == "GET" {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+
+	if req.GetBody != nil {
+		if copied, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(copied)
+			copied.Close()
+		}
+	}
+
+	entry, ok := auditEntryFor(req, body)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	audit, _ := req.Context().Value(auditContextKey{}).(auditContext)
+	entry.EventID = audit.eventID
+
+	if entry.Repo == "" {
+		entry.Repo = audit.repo
+	}
+
+	if entry.Commit == "" {
+		entry.Commit = audit.commit
+	}
+
+	digest := sha256.Sum256(body)
+	entry.PayloadSHA256 = hex.EncodeToString(digest[:])
+	entry.Time = time.Now().UTC()
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.StatusCode = resp.StatusCode
+	}
+
+	t.log.record(entry)
+
+	return resp, err
+}
+
+func formatAuditEntry(entry auditEntry) string {
+	target := entry.Repo
+	if entry.Commit != "" {
+		target += "@" + entry.Commit
+	}
+
+	if entry.PR != 0 {
+		target += fmt.Sprintf("#%d", entry.PR)
+	}
+
+	if entry.Comment != "" {
+		target += " comment " + entry.Comment
+	}
+
+	result := strconv.Itoa(entry.StatusCode)
+	if entry.Error != "" {
+		result = entry.Error
+	}
+
+	return fmt.Sprintf("%s %s %s %s event=%s sha256=%.12s", entry.Time.Format(time.RFC3339), entry.Action,
+		target, result, entry.EventID, entry.PayloadSHA256)
+}
+
+// runAudit prints the audit entries for a repo or commit
+func runAudit(args []string) error {
+	var filter auditFilter
+
+	var since time.Duration
+
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.StringVar(&filter.repo, "repo", "", "only entries for this owner/repo")
+	flags.StringVar(&filter.commit, "commit", "", "only entries for this commit, or a prefix of it")
+	flags.DurationVar(&since, "since", 7*24*time.Hour, "only entries this recent")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if auditLog == nil {
+		return fmt.Errorf("AUDIT_LOG is not set")
+	}
+
+	filter.since = time.Now().Add(-since)
+
+	entries, err := auditLog.sink.query(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Println(formatAuditEntry(entry))
+	}
+
+	return nil
+}
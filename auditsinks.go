@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// AUDIT_LOG picks where audit entries go:
+//
+//	/var/log/pipeline-monitor/audit.jsonl or file:///...  appended to a local file
+//	s3://bucket/prefix                                    one object per invocation
+//	cloudwatch://log-group                                a log stream per container
+func getAuditLog() (*auditLogger, error) {
+	value := os.Getenv("AUDIT_LOG")
+	if value == "" {
+		return nil, nil
+	}
+
+	sink, err := newAuditSink(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUDIT_LOG: %s", err)
+	}
+
+	return &auditLogger{sink: sink}, nil
+}
+
+func newAuditSink(location string) (auditSink, error) {
+	if !strings.Contains(location, "://") {
+		return &fileAuditSink{path: location}, nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &fileAuditSink{path: u.Path}, nil
+	case "s3":
+		return &s3AuditSink{bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+	case "cloudwatch":
+		return &cloudWatchAuditSink{group: u.Host + strings.TrimSuffix(u.Path, "/")}, nil
+	}
+
+	return nil, fmt.Errorf("unknown scheme %q, expected file, s3 or cloudwatch", u.Scheme)
+}
+
+func encodeAuditEntries(entries []auditEntry) ([]byte, error) {
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+
+	for _, entry := range entries {
+		err := encoder.Encode(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeAuditEntries(r io.Reader, filter auditFilter, entries []auditEntry) ([]auditEntry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var entry auditEntry
+
+		// a torn write from a crashed process shouldn't hide everything after it
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+type fileAuditSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *fileAuditSink) write(ctx context.Context, entries []auditEntry) error {
+	data, err := encodeAuditEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (s *fileAuditSink) query(ctx context.Context, filter auditFilter) ([]auditEntry, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeAuditEntries(f, filter, nil)
+}
+
+// s3AuditSink writes objects under prefix/YYYY/MM/DD/, so a query only lists
+// the days it covers
+type s3AuditSink struct {
+	bucket string
+	prefix string
+}
+
+const auditDayLayout = "2006/01/02/"
+
+func (s *s3AuditSink) dayPrefix(day time.Time) string {
+	if s.prefix == "" {
+		return day.UTC().Format(auditDayLayout)
+	}
+
+	return s.prefix + "/" + day.UTC().Format(auditDayLayout)
+}
+
+func (s *s3AuditSink) write(ctx context.Context, entries []auditEntry) error {
+	data, err := encodeAuditEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	now := time.Now()
+	key := fmt.Sprintf("%s%s-%s.jsonl", s.dayPrefix(now), now.UTC().Format("150405.000"), hex.EncodeToString(suffix))
+
+	_, err = getAWSClients().s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write s3://%s/%s: %s", s.bucket, key, err)
+	}
+
+	return nil
+}
+
+func (s *s3AuditSink) query(ctx context.Context, filter auditFilter) ([]auditEntry, error) {
+	svc := getAWSClients().s3
+
+	var entries []auditEntry
+
+	end := time.Now().UTC()
+
+	for day := filter.since.UTC().Truncate(24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+		var keys []string
+
+		err := svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(s.dayPrefix(day)),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list s3://%s/%s: %s", s.bucket, s.dayPrefix(day), err)
+		}
+
+		for _, key := range keys {
+			object, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("unable to read s3://%s/%s: %s", s.bucket, key, err)
+			}
+
+			entries, err = decodeAuditEntries(object.Body, filter, entries)
+			object.Body.Close()
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	return entries, nil
+}
+
+// cloudWatchAuditSink writes to a log stream of its own, PutLogEvents needs
+// the sequence token of the last write to a stream
+type cloudWatchAuditSink struct {
+	group  string
+	mu     sync.Mutex
+	stream string
+	token  *string
+}
+
+func (s *cloudWatchAuditSink) createStream(ctx context.Context) error {
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+
+	stream := time.Now().UTC().Format("2006/01/02/") + hex.EncodeToString(suffix)
+
+	_, err := getAWSClients().cloudWatchLogs.CreateLogStreamWithContext(ctx, &cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(s.group),
+		LogStreamName: aws.String(stream),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create log stream in %s: %s", s.group, err)
+	}
+
+	s.stream = stream
+	s.token = nil
+
+	return nil
+}
+
+// PutLogEvents rejects a batch that is not in chronological order, entries
+// from concurrent handlers are queued in the order they finished
+func auditLogEvents(entries []auditEntry) ([]*cloudwatchlogs.InputLogEvent, error) {
+	logEvents := make([]*cloudwatchlogs.InputLogEvent, 0, len(entries))
+
+	for _, entry := range entries {
+		message, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		logEvents = append(logEvents, &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(string(message)),
+			Timestamp: aws.Int64(entry.Time.UnixNano() / int64(time.Millisecond)),
+		})
+	}
+
+	sort.SliceStable(logEvents, func(i, j int) bool {
+		return aws.Int64Value(logEvents[i].Timestamp) < aws.Int64Value(logEvents[j].Timestamp)
+	})
+
+	return logEvents, nil
+}
+
+func (s *cloudWatchAuditSink) write(ctx context.Context, entries []auditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stream == "" {
+		if err := s.createStream(ctx); err != nil {
+			return err
+		}
+	}
+
+	logEvents, err := auditLogEvents(entries)
+	if err != nil {
+		return err
+	}
+
+	input := &cloudwatchlogs.PutLogEventsInput{
+		LogEvents:     logEvents,
+		LogGroupName:  aws.String(s.group),
+		LogStreamName: aws.String(s.stream),
+		SequenceToken: s.token,
+	}
+
+	output, err := getAWSClients().cloudWatchLogs.PutLogEventsWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == cloudwatchlogs.ErrCodeInvalidSequenceTokenException ||
+		aerr.Code() == cloudwatchlogs.ErrCodeDataAlreadyAcceptedException) {
+		// another writer used the stream, a fresh one avoids fighting over it
+		if err = s.createStream(ctx); err != nil {
+			return err
+		}
+
+		input.LogStreamName = aws.String(s.stream)
+		input.SequenceToken = nil
+		output, err = getAWSClients().cloudWatchLogs.PutLogEventsWithContext(ctx, input)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to put audit entries to %s: %s", s.group, err)
+	}
+
+	s.token = output.NextSequenceToken
+
+	return nil
+}
+
+func (s *cloudWatchAuditSink) query(ctx context.Context, filter auditFilter) ([]auditEntry, error) {
+	var conditions []string
+
+	if filter.repo != "" {
+		conditions = append(conditions, fmt.Sprintf("$.repo = %q", filter.repo))
+	}
+
+	if filter.commit != "" {
+		conditions = append(conditions, fmt.Sprintf("$.commit = %q", filter.commit+"*"))
+	}
+
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(s.group),
+		StartTime:    aws.Int64(filter.since.UnixNano() / int64(time.Millisecond)),
+	}
+
+	if len(conditions) > 0 {
+		input.FilterPattern = aws.String("{ " + strings.Join(conditions, " && ") + " }")
+	}
+
+	var messages strings.Builder
+
+	err := getAWSClients().cloudWatchLogs.FilterLogEventsPagesWithContext(ctx, input,
+		func(page *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+			for _, event := range page.Events {
+				messages.WriteString(aws.StringValue(event.Message))
+				messages.WriteString("\n")
+			}
+
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query %s: %s", s.group, err)
+	}
+
+	entries, err := decodeAuditEntries(strings.NewReader(messages.String()), filter, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	return entries, nil
+}
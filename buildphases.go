@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+)
+
+type buildPhase struct {
+	name     string
+	status   string
+	duration time.Duration
+	message  string
+}
+
+type buildSummary struct {
+	status   string
+	duration time.Duration
+	phases   []buildPhase
+}
+
+// the COMPLETED phase never has a status, every other phase that did not
+// succeed is a candidate for where the build broke
+func (p buildPhase) failed() bool {
+	return p.status != "" && p.status != "SUCCEEDED"
+}
+
+// collect the phase information that BatchGetBuilds returns so that the
+// comment can show where a build broke without expanding the log
+// https://docs.aws.amazon.com/codebuild/latest/APIReference/API_BuildPhase.html
+func summarizeBuild(build *codebuild.Build) buildSummary {
+	summary := buildSummary{
+		status: aws.StringValue(build.BuildStatus),
+	}
+
+	if build.StartTime != nil && build.EndTime != nil {
+		summary.duration = build.EndTime.Sub(*build.StartTime).Round(time.Second)
+	}
+
+	for _, p := range build.Phases {
+		phase := buildPhase{
+			name:     aws.StringValue(p.PhaseType),
+			status:   aws.StringValue(p.PhaseStatus),
+			duration: time.Duration(aws.Int64Value(p.DurationInSeconds)) * time.Second,
+		}
+
+		if phase.failed() {
+			var messages []string
+
+			for _, c := range p.Contexts {
+				if msg := aws.StringValue(c.Message); msg != "" {
+					messages = append(messages, msg)
+				}
+			}
+
+			phase.message = strings.Join(messages, "; ")
+		}
+
+		summary.phases = append(summary.phases, phase)
+	}
+
+	return summary
+}
+
+// markdown table cells can't contain pipes or newlines
+func escapeTableCell(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	s = strings.ReplaceAll(s, "\r", "")
+
+	return strings.ReplaceAll(s, "\n", " ")
+}
+
+func formatPhaseTable(summary buildSummary) string {
+	var table strings.Builder
+
+	fmt.Fprintf(&table, "**Build status:** %s in %s\n\n", summary.status, summary.duration)
+
+	if len(summary.phases) == 0 {
+		return table.String()
+	}
+
+	table.WriteString("| Phase | Status | Duration | Details |\n")
+	table.WriteString("|-------|--------|----------|---------|\n")
+
+	for _, p := range summary.phases {
+		status := p.status
+		if status == "" {
+			// the COMPLETED phase has no status or duration
+			status = "-"
+		}
+
+		fmt.Fprintf(&table, "| %s | %s | %s | %s |\n",
+			p.name, status, p.duration, escapeTableCell(p.message))
+	}
+
+	return table.String()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// clients are created once per lambda container and shared by every warm
+// invocation instead of building a new session for each API call
+type awsClients struct {
+	codePipeline   *codepipeline.CodePipeline
+	codeBuild      *codebuild.CodeBuild
+	cloudWatchLogs *cloudwatchlogs.CloudWatchLogs
+	s3             *s3.S3
+	sts            *sts.STS
+}
+
+var (
+	sharedAWSClients    awsClients
+	sharedAWSClientsSet sync.Once
+)
+
+func getAWSClients() *awsClients {
+	sharedAWSClientsSet.Do(func() {
+		sess := session.Must(session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		}))
+		traceAWSRequests(&sess.Handlers)
+		limitAWSRequests(&sess.Handlers)
+
+		sharedAWSClients = awsClients{
+			codePipeline:   codepipeline.New(sess),
+			codeBuild:      codebuild.New(sess),
+			cloudWatchLogs: cloudwatchlogs.New(sess),
+			s3:             s3.New(sess),
+			sts:            sts.New(sess),
+		}
+	})
+
+	return &sharedAWSClients
+}
+
+type revisionCacheEntry struct {
+	info    revisionInfo
+	expires time.Time
+}
+
+type revisionLookup struct {
+	done chan struct{}
+	info *revisionInfo
+	err  error
+}
+
+// revisionCache remembers which commit a pipeline execution is building, a
+// single execution emits dozens of action events that all need the same
+// answer from GetPipelineExecution
+type revisionCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	size     int
+	entries  map[string]revisionCacheEntry
+	inflight map[string]*revisionLookup
+}
+
+func newRevisionCache(size int, ttl time.Duration) *revisionCache {
+	return &revisionCache{
+		ttl:      ttl,
+		size:     size,
+		entries:  make(map[string]revisionCacheEntry),
+		inflight: make(map[string]*revisionLookup),
+	}
+}
+
+// get returns the cached revision for key, or calls lookup to find it.
+// Concurrent callers asking for the same key share a single lookup, and stop
+// waiting for it when their own ctx is done.
+func (c *revisionCache) get(ctx context.Context, key string,
+	lookup func() (*revisionInfo, error)) (*revisionInfo, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		c.mu.Unlock()
+
+		info := entry.info
+
+		return &info, nil
+	}
+
+	if pending, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+
+		select {
+		case <-pending.done:
+			return pending.info, pending.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	pending := &revisionLookup{done: make(chan struct{})}
+	c.inflight[key] = pending
+	c.mu.Unlock()
+
+	pending.info, pending.err = lookup()
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+
+	if pending.err == nil {
+		c.evict(now)
+		c.entries[key] = revisionCacheEntry{info: *pending.info, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	close(pending.done)
+
+	return pending.info, pending.err
+}
+
+// make room for one more entry, dropping expired entries first and then the
+// one closest to expiring. Callers hold the lock.
+func (c *revisionCache) evict(now time.Time) {
+	if len(c.entries) < c.size {
+		return
+	}
+
+	var oldestKey string
+
+	var oldest time.Time
+
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+
+	if len(c.entries) >= c.size {
+		delete(c.entries, oldestKey)
+	}
+}
@@ -4,37 +4,42 @@ import (
 	"context"
 	"fmt"
 	"html/template"
+	"log"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/client"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/codebuild"
 	"github.com/google/go-github/github"
-	"golang.org/x/oauth2"
 )
 
-type codeBuildLogInfo struct {
-	groupName  string
-	streamName string
-	deepLink   string
-}
-
 type buildDetails struct {
-	owner      string
-	repo       string
-	prID       int
-	commitID   string
-	logInfo    codeBuildLogInfo
-	body       string
-	commentTag string
+	host        string
+	owner       string
+	repo        string
+	prID        int
+	commitID    string
+	logs        logSource
+	buildID     string
+	summary     buildSummary
+	trend       *buildTrend
+	cost        *buildCost
+	prCost      *pullRequestCost
+	artifacts   []artifactLink
+	outputs     []*codebuild.BuildArtifacts
+	junit       testReport
+	projectName string
+	limit       int
+	log         string
+	logOffset   int // lines before the retrieved log, or unknownOffset
+	body        string
+	commentTag  string
 }
 
 type revisionInfo struct {
+	host   string
 	owner  string
 	repo   string
 	commit string
@@ -70,6 +75,7 @@ func parseRepoURL(revisionURL string) (revisionInfo, error) {
 	}
 
 	info := revisionInfo{
+		host:  u.Host,
 		owner: matches["owner"],
 		repo:  matches["repo"],
 	}
@@ -77,35 +83,12 @@ func parseRepoURL(revisionURL string) (revisionInfo, error) {
 	return info, nil
 }
 
-func getCodeBuildLog(sess client.ConfigProvider, info codeBuildLogInfo, limit int) (string, error) {
-	svc := cloudwatchlogs.New(sess)
-	resp, err := svc.GetLogEvents(&cloudwatchlogs.GetLogEventsInput{
-		Limit:         aws.Int64(int64(limit)),
-		LogGroupName:  aws.String(info.groupName),
-		LogStreamName: aws.String(info.streamName),
-	})
-
-	if err != nil {
-		return "", err
-	}
-
-	var body strings.Builder
-
-	for _, event := range resp.Events {
-		body.WriteString(*event.Message)
-	}
-
-	return body.String(), nil
-}
-
-func getCodeBuildDetails(buildID string, limit int, projectName string) (buildDetails, error) {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+func getCodeBuildDetails(ctx context.Context, buildID string, limit int, projectName string) (buildDetails, error) {
+	clients := getAWSClients()
 
 	// change this to use an interface so that this can be mocked/tested
 	// https://docs.aws.amazon.com/sdk-for-go/api/service/codepipeline/codepipelineiface/
-	svc := codebuild.New(sess)
+	svc := clients.codeBuild
 
 	apiInput := &codebuild.BatchGetBuildsInput{
 		Ids: []*string{aws.String(buildID)},
@@ -113,14 +96,15 @@ func getCodeBuildDetails(buildID string, limit int, projectName string) (buildDe
 
 	var data buildDetails
 
-	result, err := svc.BatchGetBuilds(apiInput)
+	result, err := svc.BatchGetBuildsWithContext(ctx, apiInput)
 	if err != nil || len(result.Builds) != 1 {
 		return data, fmt.Errorf("unexpected %d results for build-id: %s", len(result.Builds), buildID)
 	}
 
 	build := result.Builds[0]
-	if *build.Source.Type != "GITHUB" {
-		return data, fmt.Errorf("this only works with Source.Type == GITHUB, found Source.Type == %s", *build.Source.Type)
+	if sourceType := aws.StringValue(build.Source.Type); sourceType != codebuild.SourceTypeGithub &&
+		sourceType != codebuild.SourceTypeGithubEnterprise {
+		return data, fmt.Errorf("this only works with GitHub sources, found Source.Type == %s", sourceType)
 	}
 
 	info, err := parseRepoURL(*build.Source.Location)
@@ -129,11 +113,17 @@ func getCodeBuildDetails(buildID string, limit int, projectName string) (buildDe
 	}
 
 	data.commitID = *build.ResolvedSourceVersion
+	data.host = info.host
 	data.owner = info.owner
 	data.repo = info.repo
-	data.logInfo.groupName = *build.Logs.GroupName
-	data.logInfo.streamName = *build.Logs.StreamName
-	data.logInfo.deepLink = *build.Logs.DeepLink
+	data.buildID = *build.Id
+	data.summary = summarizeBuild(build)
+	data.outputs = buildArtifacts(build)
+
+	if cost, ok := estimateBuildCost(build, prices); ok {
+		data.cost = &cost
+	}
+
 	data.prID, err = parsePrID(*build.SourceVersion)
 
 	if err != nil {
@@ -141,45 +131,120 @@ func getCodeBuildDetails(buildID string, limit int, projectName string) (buildDe
 	}
 
 	data.commentTag = "PIPELINE_MONITOR_GENERATED_LOG_COMMENT_" + strings.ToUpper(projectName)
-	logBody, err := getCodeBuildLog(sess, data.logInfo, limit)
+	data.projectName = projectName
+	data.limit = limit
+
+	data.logs, err = newLogSource(clients, build)
+	if err != nil {
+		return data, err
+	}
+
+	data.log, data.logOffset, err = data.logs.fetch(ctx, limit)
 
 	if err != nil {
-		return data, fmt.Errorf("error retrieving codebuild logs for %s: %s", *build.Logs.DeepLink, err)
+		return data, fmt.Errorf("error retrieving codebuild logs for %s: %s", data.logs.deepLink(), err)
 	}
 
-	commentData := map[string]string{
-		"body":           logBody,
+	if artifactLinksEnabled(projectName) {
+		data.artifacts, err = listBuildArtifacts(ctx, clients.s3, build, artifactLinkExpiry)
+		if err != nil {
+			// the comment is still useful without the artifacts
+			log.Printf("Unable to link artifacts of %s: %s", buildID, err)
+		}
+	}
+
+	return data, nil
+}
+
+// render the log comment body, the repo config decides how the log is
+// excerpted and what gets redacted
+func formatLogComment(data *buildDetails, config *repoConfig) error {
+	logBody := config.redact(data.log)
+	sections := excerptLog(logBody, config.Excerpt, config.PhaseLogLines, failedPhaseNames(data.summary))
+
+	likelyErrors := findErrorLines(logBody, config.errorPatterns, config.ErrorLines, errorContextLines)
+
+	tests := buildTestReport(logBody, logTruncated(data.log, data.limit), data.junit)
+
+	var mentions string
+	if data.summary.status != "SUCCEEDED" && len(config.Mentions) > 0 {
+		mentions = "cc " + strings.Join(config.Mentions, " ")
+	}
+
+	commentData := map[string]interface{}{
+		"artifacts":      formatArtifacts(data.artifacts, artifactLinkExpiry),
 		"commentTag":     data.commentTag,
-		"deepLink":       data.logInfo.deepLink,
-		"limit":          strconv.Itoa(limit),
-		"projectName":    projectName,
+		"cost":           formatBuildCost(data.cost, data.prCost),
+		"deepLink":       data.logs.deepLink(),
+		"errors":         formatErrorLines(likelyErrors, data.limit, data.logOffset),
+		"limit":          strconv.Itoa(data.limit),
+		"logStore":       data.logs.name(),
+		"mentions":       mentions,
+		"phaseLimit":     strconv.Itoa(config.PhaseLogLines),
+		"phaseTable":     formatPhaseTable(data.summary),
+		"projectName":    data.projectName,
+		"sections":       sections,
+		"tests":          formatTestReport(tests, config.SlowestTests, config),
+		"trend":          formatBuildTrend(data.trend),
 		"tripleBacktick": "```",
 	}
 	commentHiddenTag := fmt.Sprintf("<!-- %s -->\n", data.commentTag)
 	commentTemplate := `
-## First {{.limit}} lines of {{.projectName}} latest build log
+## Latest {{.limit}} lines of {{.projectName}} build log
+{{- if .errors}}
+{{.errors}}
+{{- end}}
+{{- with .tests}}
+{{.Totals}}
+{{range .Failures}}
 <details>
-  <summary>Click to expand the latest build log!</summary>
+  <summary>{{.Name}}</summary>
 
-  ## Link to [original cloudwatch log]({{.deepLink}})
-{{.tripleBacktick}}
-{{.body}}
-{{.tripleBacktick}}
+{{$.tripleBacktick}}
+{{.Message}}
+{{$.tripleBacktick}}
+</details>
+{{end}}
+{{- if .Slowest}}
+{{.Slowest}}
+{{- end}}
+{{- end}}
+{{.phaseTable}}
+{{- if .cost}}
+{{.cost}}
+{{- end}}
+{{- if .trend}}
+{{.trend}}
+{{- end}}
+{{- if .artifacts}}
+{{.artifacts}}
+{{- end}}
+{{- if .mentions}}
+{{.mentions}}
+{{end}}
+Link to [original {{.logStore}} log]({{.deepLink}}), showing at most {{.phaseLimit}} lines of each section.
+{{range .sections}}
+<details{{if .Open}} open{{end}}>
+  <summary>{{.Name}} ({{.Lines}} lines{{if .Omitted}}, {{.Omitted}} omitted{{end}})</summary>
+
+{{$.tripleBacktick}}
+{{.Body}}
+{{$.tripleBacktick}}
 </details>
-`
+{{end}}`
 
 	var body strings.Builder
 
 	t := template.Must(template.New("t1").Parse(commentTemplate))
-	err = t.Execute(&body, commentData)
+	err := t.Execute(&body, commentData)
 
 	if err != nil {
-		return data, fmt.Errorf("error formatting comment template: %s", err)
+		return fmt.Errorf("error formatting comment template: %s", err)
 	}
 	// commentHiddenTag must be separate because go templates strip HTML comments
 	data.body = commentHiddenTag + body.String()
 
-	return data, err
+	return nil
 }
 
 func parsePrID(sourceVersion string) (int, error) {
@@ -210,31 +275,19 @@ func parsePrID(sourceVersion string) (int, error) {
 	return number, nil
 }
 
-func upsertGitHubLogComment(details *buildDetails, token string) error {
-	// guidance on auth from https://github.com/google/go-github#authentication
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-	gh := github.NewClient(tc)
-
-	// iterate PR comments
-	opt := &github.IssueListCommentsOptions{Sort: "updated", Direction: "desc"}
-	comments, _, err := gh.Issues.ListComments(ctx, details.owner, details.repo, details.prID, opt)
+// post the new log comment, then delete or minimize the ones it replaces
+func upsertGitHubLogComment(ctx context.Context, gh *github.Client, details *buildDetails, config *repoConfig) error {
+	previous, err := listTaggedComments(ctx, gh, details.owner, details.repo, details.prID, details.commentTag)
 	if err != nil {
 		return err
 	}
 
-	// delete old comment, we will post a new one
-	for _, comment := range comments {
-		if strings.Contains(*comment.Body, details.commentTag) {
-			_, _ = gh.Issues.DeleteComment(ctx, details.owner, details.repo, *comment.ID)
-		}
-	}
-
 	comment := &github.IssueComment{Body: &details.body}
+
 	_, _, err = gh.Issues.CreateComment(ctx, details.owner, details.repo, details.prID, comment)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return retireComments(ctx, gh, details.owner, details.repo, previous, config)
 }
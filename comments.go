@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	outdatedDelete   = "delete"
+	outdatedMinimize = "minimize"
+)
+
+// go-github v17 drops node_id from issue comments, which GraphQL needs to
+// find the comment again
+type taggedComment struct {
+	ID        int64     `json:"id"`
+	NodeID    string    `json:"node_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// every comment on the PR carrying commentTag, newest first
+func listTaggedComments(ctx context.Context, gh *github.Client, owner, repo string, prID int,
+	commentTag string) ([]taggedComment, error) {
+	var tagged []taggedComment
+
+	for page := 1; page != 0; {
+		u := fmt.Sprintf("repos/%s/%s/issues/%d/comments?per_page=100&page=%d", owner, repo, prID, page)
+
+		req, err := gh.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var comments []taggedComment
+
+		resp, err := gh.Do(ctx, req, &comments)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list comments on %s/%s#%d: %s", owner, repo, prID, err)
+		}
+
+		for _, comment := range comments {
+			if strings.Contains(comment.Body, commentTag) {
+				tagged = append(tagged, comment)
+			}
+		}
+
+		page = resp.NextPage
+	}
+
+	sort.SliceStable(tagged, func(i, j int) bool { return tagged[i].CreatedAt.After(tagged[j].CreatedAt) })
+
+	return tagged, nil
+}
+
+// split outdated comments, newest first, into the ones kept minimized and
+// the ones past the retention count that get deleted
+func retainComments(comments []taggedComment, policy string, keep int) (minimize, remove []taggedComment) {
+	if policy != outdatedMinimize {
+		return nil, comments
+	}
+
+	if keep > len(comments) {
+		keep = len(comments)
+	}
+
+	return comments[:keep], comments[keep:]
+}
+
+// retireComments hides or deletes comments that a newer one replaced, as the
+// repo config asks
+func retireComments(ctx context.Context, gh *github.Client, owner, repo string, comments []taggedComment,
+	config *repoConfig) error {
+	minimize, remove := retainComments(comments, config.OutdatedComments, config.KeepOutdatedComments)
+
+	for _, comment := range remove {
+		_, err := gh.Issues.DeleteComment(ctx, owner, repo, comment.ID)
+		if err != nil {
+			// a comment someone else already deleted is not worth failing over
+			log.Printf("Unable to delete comment %d on %s/%s: %s", comment.ID, owner, repo, err)
+		}
+	}
+
+	nodeIDs := make([]string, 0, len(minimize))
+	for _, comment := range minimize {
+		nodeIDs = append(nodeIDs, comment.NodeID)
+	}
+
+	return minimizeComments(ctx, gh, nodeIDs)
+}
+
+const (
+	commentAlways  = "always"
+	commentFailure = "failure"
+	commentFixed   = "fixed"
+)
+
+// marks the note left behind in fixed mode, so a second green build does
+// not post another one
+const fixedNoteMarker = "<!-- PIPELINE_MONITOR_FIXED -->"
+
+func validCommentPolicy(policy string) bool {
+	switch policy {
+	case commentAlways, commentFailure, commentFixed:
+		return true
+	}
+
+	return false
+}
+
+func (c *repoConfig) commentPolicy(projectName string) string {
+	if policy, ok := c.ProjectCommentPolicies[projectName]; ok {
+		return policy
+	}
+
+	return c.CommentPolicy
+}
+
+func formatFixedNote(details *buildDetails) string {
+	return fmt.Sprintf("<!-- %s -->\n%s\n### %s is passing again\n\n"+
+		"Build `%s` succeeded in %s, see the [%s log](%s).\n",
+		details.commentTag, fixedNoteMarker, details.projectName,
+		details.buildID, details.summary.duration, details.logs.name(), details.logs.deepLink())
+}
+
+// resolveLogComments handles a green build when only failures get a log
+// comment: the failure comments it fixed are cleared, and in fixed mode a
+// short note says so
+func resolveLogComments(ctx context.Context, gh *github.Client, details *buildDetails, config *repoConfig) error {
+	previous, err := listTaggedComments(ctx, gh, details.owner, details.repo, details.prID, details.commentTag)
+	if err != nil {
+		return err
+	}
+
+	// nothing failed, or the fix was already noted
+	if len(previous) == 0 || strings.Contains(previous[0].Body, fixedNoteMarker) {
+		return nil
+	}
+
+	if config.commentPolicy(details.projectName) == commentFixed {
+		body := formatFixedNote(details)
+
+		_, _, err = gh.Issues.CreateComment(ctx, details.owner, details.repo, details.prID,
+			&github.IssueComment{Body: &body})
+		if err != nil {
+			return err
+		}
+	}
+
+	return retireComments(ctx, gh, details.owner, details.repo, previous, config)
+}
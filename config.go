@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"gopkg.in/yaml.v2"
+)
+
+const repoConfigPath = ".github/pipeline-monitor.yml"
+
+// repoConfig is read from .github/pipeline-monitor.yml at the commit under
+// test, so that each repository can tune the monitor without redeploying it
+//
+//	comments: true
+//	statuses: true
+//	excerpt: phases # phases, head or tail
+//	phase_log_lines: 200
+//	redact:
+//	  - 'AKIA[0-9A-Z]{16}'
+//	labels:
+//	  deploy-prod: Production deploy
+//	mentions:
+//	  - '@kindlyops/platform'
+//	trend_builds: 10 # 0 turns off the duration trend
+//	trend_threshold_percent: 25
+//	pipeline_overview: true
+//	comment_policy: always # always, failure or fixed
+//	project_comment_policies:
+//	  lint: failure
+//	outdated_comments: minimize # or delete
+//	keep_outdated_comments: 5 # minimized comments kept before deleting
+//	error_lines: 10 # 0 turns off the likely errors block
+//	error_patterns:
+//	  - 'ERROR \['
+//	stuck_after: # by action name or category
+//	  deploy-prod: 20m
+//	  Approval: 4h
+//	slowest_tests: 5 # 0 leaves the slowest tests out of the test report
+//	junit_reports: # unpackaged artifact files with JUnit XML results
+//	  - 'reports/*.xml'
+type repoConfig struct {
+	Comments      bool              `yaml:"comments"`
+	Statuses      bool              `yaml:"statuses"`
+	Excerpt       string            `yaml:"excerpt"`
+	PhaseLogLines int               `yaml:"phase_log_lines"`
+	Redact        []string          `yaml:"redact"`
+	Labels        map[string]string `yaml:"labels"`
+	Mentions      []string          `yaml:"mentions"`
+
+	CommentPolicy          string            `yaml:"comment_policy"`
+	ProjectCommentPolicies map[string]string `yaml:"project_comment_policies"`
+
+	OutdatedComments     string `yaml:"outdated_comments"`
+	KeepOutdatedComments int    `yaml:"keep_outdated_comments"`
+
+	ErrorLines    int      `yaml:"error_lines"`
+	ErrorPatterns []string `yaml:"error_patterns"`
+
+	TrendBuilds           int `yaml:"trend_builds"`
+	TrendThresholdPercent int `yaml:"trend_threshold_percent"`
+
+	PipelineOverview bool `yaml:"pipeline_overview"`
+
+	StuckAfter map[string]time.Duration `yaml:"stuck_after"`
+
+	SlowestTests int      `yaml:"slowest_tests"`
+	JUnitReports []string `yaml:"junit_reports"`
+
+	redactPatterns []*regexp.Regexp
+	errorPatterns  []*regexp.Regexp
+}
+
+const (
+	excerptPhases = "phases"
+	excerptHead   = "head"
+	excerptTail   = "tail"
+)
+
+func defaultRepoConfig() repoConfig {
+	return repoConfig{
+		Comments:      true,
+		Statuses:      true,
+		Excerpt:       excerptPhases,
+		PhaseLogLines: maxPhaseLogLines,
+		ErrorLines:    10,
+
+		CommentPolicy: commentAlways,
+
+		OutdatedComments:     outdatedDelete,
+		KeepOutdatedComments: 5,
+
+		TrendBuilds:           10,
+		TrendThresholdPercent: 25,
+
+		PipelineOverview: true,
+
+		SlowestTests: 5,
+
+		errorPatterns: builtinErrorPatterns,
+	}
+}
+
+func parseRepoConfig(contents []byte) (repoConfig, error) {
+	config := defaultRepoConfig()
+
+	err := yaml.UnmarshalStrict(contents, &config)
+	if err != nil {
+		return defaultRepoConfig(), fmt.Errorf("unable to parse %s: %s", repoConfigPath, err)
+	}
+
+	switch config.Excerpt {
+	case excerptPhases, excerptHead, excerptTail:
+	default:
+		return defaultRepoConfig(), fmt.Errorf("unknown excerpt strategy %q in %s", config.Excerpt, repoConfigPath)
+	}
+
+	switch config.OutdatedComments {
+	case outdatedDelete, outdatedMinimize:
+	default:
+		return defaultRepoConfig(), fmt.Errorf("unknown outdated_comments policy %q in %s",
+			config.OutdatedComments, repoConfigPath)
+	}
+
+	if !validCommentPolicy(config.CommentPolicy) {
+		return defaultRepoConfig(), fmt.Errorf("unknown comment_policy %q in %s", config.CommentPolicy, repoConfigPath)
+	}
+
+	for project, policy := range config.ProjectCommentPolicies {
+		if !validCommentPolicy(policy) {
+			return defaultRepoConfig(), fmt.Errorf("unknown comment policy %q for %s in %s",
+				policy, project, repoConfigPath)
+		}
+	}
+
+	if config.KeepOutdatedComments < 0 {
+		config.KeepOutdatedComments = 0
+	}
+
+	if config.SlowestTests < 0 {
+		config.SlowestTests = 0
+	}
+
+	for _, pattern := range config.JUnitReports {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return defaultRepoConfig(), fmt.Errorf("invalid junit_reports pattern %q in %s: %s",
+				pattern, repoConfigPath, err)
+		}
+	}
+
+	if config.PhaseLogLines <= 0 || config.PhaseLogLines > maxLogLines {
+		config.PhaseLogLines = maxPhaseLogLines
+	}
+
+	// one page of ListBuildsForProject is all we look at
+	if config.TrendBuilds > 100 {
+		config.TrendBuilds = 100
+	}
+
+	for _, pattern := range config.Redact {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return defaultRepoConfig(), fmt.Errorf("invalid redact pattern %q in %s: %s", pattern, repoConfigPath, err)
+		}
+
+		config.redactPatterns = append(config.redactPatterns, re)
+	}
+
+	config.errorPatterns = append([]*regexp.Regexp(nil), builtinErrorPatterns...)
+
+	for _, pattern := range config.ErrorPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return defaultRepoConfig(), fmt.Errorf("invalid error pattern %q in %s: %s", pattern, repoConfigPath, err)
+		}
+
+		config.errorPatterns = append(config.errorPatterns, re)
+	}
+
+	return config, nil
+}
+
+func (c *repoConfig) redact(s string) string {
+	for _, re := range c.redactPatterns {
+		s = re.ReplaceAllString(s, "[REDACTED]")
+	}
+
+	return s
+}
+
+// configs are immutable for a given commit, so warm lambda invocations can
+// skip the GitHub API call for every event after the first one. A file that
+// doesn't parse is cached with its error, it fails the same way every time.
+var repoConfigCache = struct {
+	sync.Mutex
+	entries map[string]repoConfigEntry
+}{entries: make(map[string]repoConfigEntry)}
+
+type repoConfigEntry struct {
+	config repoConfig
+	err    error
+}
+
+const repoConfigCacheSize = 256
+
+func loadRepoConfig(ctx context.Context, gh *github.Client, owner, repo, commitID string) repoConfig {
+	key := fmt.Sprintf("%s/%s@%s", owner, repo, commitID)
+
+	repoConfigCache.Lock()
+	entry, ok := repoConfigCache.entries[key]
+	repoConfigCache.Unlock()
+
+	if ok {
+		return entry.config
+	}
+
+	contents, err := fetchRepoConfig(ctx, gh, owner, repo, commitID)
+	if err != nil {
+		// not cached, the next event may find GitHub answering again
+		log.Printf("Using default configuration for %s: %s", key, err)
+		return defaultRepoConfig()
+	}
+
+	entry.config, entry.err = parseRepoConfig(contents)
+	if entry.err != nil {
+		// a broken config file should not stop statuses and comments
+		log.Printf("Using default configuration for %s: %s", key, entry.err)
+	}
+
+	repoConfigCache.Lock()
+	if len(repoConfigCache.entries) >= repoConfigCacheSize {
+		repoConfigCache.entries = make(map[string]repoConfigEntry)
+	}
+	repoConfigCache.entries[key] = entry
+	repoConfigCache.Unlock()
+
+	return entry.config
+}
+
+// the contents of the config file at a commit, nil when there is none
+func fetchRepoConfig(ctx context.Context, gh *github.Client, owner, repo, commitID string) ([]byte, error) {
+	opt := &github.RepositoryContentGetOptions{Ref: commitID}
+	file, _, resp, err := gh.Repositories.GetContents(ctx, owner, repo, repoConfigPath, opt)
+
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		// the file is optional
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve %s: %s", repoConfigPath, err)
+	}
+
+	if file == nil {
+		return nil, fmt.Errorf("%s is a directory", repoConfigPath)
+	}
+
+	contents, err := file.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %s", repoConfigPath, err)
+	}
+
+	return []byte(contents), nil
+}
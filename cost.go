@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/google/go-github/github"
+)
+
+// priceTable holds USD per build minute by region and then compute type, the
+// "*" region applies when there is no entry for the build's region
+type priceTable map[string]map[string]float64
+
+// on-demand Linux prices in us-east-1
+// https://aws.amazon.com/codebuild/pricing/
+var defaultPrices = priceTable{
+	"*": {
+		"BUILD_GENERAL1_SMALL":   0.005,
+		"BUILD_GENERAL1_MEDIUM":  0.01,
+		"BUILD_GENERAL1_LARGE":   0.02,
+		"BUILD_GENERAL1_2XLARGE": 0.2,
+	},
+}
+
+// CODEBUILD_PRICE_TABLE overrides the defaults, for example
+// {"eu-west-1": {"BUILD_GENERAL1_SMALL": 0.006}}
+func getPriceTable() priceTable {
+	prices := priceTable{}
+
+	for region, computeTypes := range defaultPrices {
+		prices[region] = map[string]float64{}
+		for computeType, price := range computeTypes {
+			prices[region][computeType] = price
+		}
+	}
+
+	overrides := os.Getenv("CODEBUILD_PRICE_TABLE")
+	if overrides == "" {
+		return prices
+	}
+
+	var custom priceTable
+
+	err := json.Unmarshal([]byte(overrides), &custom)
+	if err != nil {
+		log.Printf("Ignoring invalid CODEBUILD_PRICE_TABLE: %s", err)
+		return prices
+	}
+
+	for region, computeTypes := range custom {
+		if prices[region] == nil {
+			prices[region] = map[string]float64{}
+		}
+
+		for computeType, price := range computeTypes {
+			prices[region][computeType] = price
+		}
+	}
+
+	return prices
+}
+
+func (p priceTable) perMinute(region, computeType string) (float64, bool) {
+	if price, ok := p[region][computeType]; ok {
+		return price, true
+	}
+
+	price, ok := p["*"][computeType]
+
+	return price, ok
+}
+
+type buildCost struct {
+	computeType string
+	minutes     int64
+	amount      float64
+}
+
+// CodeBuild bills every started minute from the end of the QUEUED phase
+func billableMinutes(summary buildSummary) int64 {
+	billed := summary.duration
+
+	for _, p := range summary.phases {
+		if p.name == "QUEUED" {
+			billed -= p.duration
+		}
+	}
+
+	if billed <= 0 {
+		return 0
+	}
+
+	return int64(math.Ceil(billed.Minutes()))
+}
+
+func estimateBuildCost(build *codebuild.Build, table priceTable) (buildCost, bool) {
+	var cost buildCost
+
+	if build.Environment == nil {
+		return cost, false
+	}
+
+	// arn:aws:codebuild:us-east-1:123456789012:build/project:id
+	var region string
+	if parts := strings.SplitN(aws.StringValue(build.Arn), ":", 6); len(parts) == 6 {
+		region = parts[3]
+	}
+
+	cost.computeType = aws.StringValue(build.Environment.ComputeType)
+
+	price, ok := table.perMinute(region, cost.computeType)
+	if !ok {
+		return cost, false
+	}
+
+	cost.minutes = billableMinutes(summarizeBuild(build))
+	cost.amount = float64(cost.minutes) * price
+
+	return cost, true
+}
+
+// ListBuildsForProject pages hold 100 builds, the PR total looks this many
+// pages back for the first build of the PR
+const maxCostPages = 10
+
+// pullRequestCost adds up the builds of a PR, cutoff is when the oldest build
+// looked at started if the pages ran out before the PR was opened
+type pullRequestCost struct {
+	builds int
+	amount float64
+	cutoff time.Time
+}
+
+// add the builds of the PR in one page of builds, newest first, and report
+// whether the page reaches back to when the PR was opened
+func (c *pullRequestCost) addPage(builds []*codebuild.Build, sourceVersion string, opened time.Time,
+	table priceTable) bool {
+	for _, build := range builds {
+		started := aws.TimeValue(build.StartTime)
+		if !opened.IsZero() && started.Before(opened) {
+			return true
+		}
+
+		c.cutoff = started
+
+		if aws.StringValue(build.SourceVersion) != sourceVersion {
+			continue
+		}
+
+		if cost, ok := estimateBuildCost(build, table); ok {
+			c.builds++
+			c.amount += cost.amount
+		}
+	}
+
+	return false
+}
+
+// add up this build and every earlier build of the same PR. PR builds can't
+// start before the PR was opened, so the pages of recent builds are followed
+// back to then, or for maxCostPages on busy projects.
+func addPullRequestCost(ctx context.Context, gh *github.Client, details *buildDetails,
+	recent []*codebuild.Build, next *string) {
+	if details.cost == nil {
+		return
+	}
+
+	var opened time.Time
+
+	pr, _, err := gh.PullRequests.Get(ctx, details.owner, details.repo, details.prID)
+	if err != nil {
+		log.Printf("Unable to find when %s/%s#%d was opened: %s", details.owner, details.repo, details.prID, err)
+	} else {
+		opened = pr.GetCreatedAt()
+	}
+
+	total := pullRequestCost{builds: 1, amount: details.cost.amount}
+	sourceVersion := fmt.Sprintf("pr/%d", details.prID)
+
+	builds := recent
+
+	for page := 1; !total.addPage(builds, sourceVersion, opened, prices); page++ {
+		if next == nil {
+			// every build of the project was looked at
+			total.cutoff = time.Time{}
+			break
+		}
+
+		if page == maxCostPages {
+			break
+		}
+
+		builds, next, err = listRecentBuilds(ctx, details.projectName, details.buildID, next)
+		if err != nil {
+			log.Printf("Unable to add up the builds of %s/%s#%d: %s", details.owner, details.repo, details.prID, err)
+			break
+		}
+	}
+
+	details.prCost = &total
+}
+
+func formatBuildCost(cost *buildCost, prCost *pullRequestCost) string {
+	if cost == nil {
+		return ""
+	}
+
+	var text strings.Builder
+
+	fmt.Fprintf(&text, "**Estimated cost:** $%.3f for %d billed minutes on %s",
+		cost.amount, cost.minutes, cost.computeType)
+
+	if prCost != nil && prCost.builds > 1 {
+		fmt.Fprintf(&text, ", $%.3f across %d builds of this PR", prCost.amount, prCost.builds)
+
+		if !prCost.cutoff.IsZero() {
+			fmt.Fprintf(&text, " since %s", prCost.cutoff.UTC().Format("2006-01-02 15:04 MST"))
+		}
+	}
+
+	text.WriteString("\n")
+
+	return text.String()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// time kept back from every call to log what is incomplete and flush the
+	// audit log and traces before Lambda stops the invocation
+	deadlineReserve = 2 * time.Second
+
+	// no single call may take longer than this, even early in an invocation
+	maxCallTimeout = 30 * time.Second
+)
+
+// inflightWork lists what an invocation has started and not yet finished,
+// so a timeout can say what it interrupted
+type inflightWork struct {
+	mu    sync.Mutex
+	next  int
+	items map[int]inflightItem
+}
+
+type inflightItem struct {
+	description string
+	started     time.Time
+}
+
+type inflightKey struct{}
+
+func withInflightWork(ctx context.Context) (context.Context, *inflightWork) {
+	work := &inflightWork{items: make(map[int]inflightItem)}
+	return context.WithValue(ctx, inflightKey{}, work), work
+}
+
+// trackWork records the start of a step, call the returned func when it is
+// done. Contexts without a tracker, e.g. in tests, track nothing.
+func trackWork(ctx context.Context, description string) func() {
+	work, _ := ctx.Value(inflightKey{}).(*inflightWork)
+	if work == nil {
+		return func() {}
+	}
+
+	work.mu.Lock()
+	id := work.next
+	work.next++
+	work.items[id] = inflightItem{description: description, started: time.Now()}
+	work.mu.Unlock()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			work.mu.Lock()
+			delete(work.items, id)
+			work.mu.Unlock()
+		})
+	}
+}
+
+// pending describes the unfinished steps, oldest first
+func (w *inflightWork) pending(now time.Time) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ids := make([]int, 0, len(w.items))
+	for id := range w.items {
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	descriptions := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		item := w.items[id]
+		descriptions = append(descriptions, item.description+" (for "+formatElapsed(now.Sub(item.started))+")")
+	}
+
+	return descriptions
+}
+
+// watchDeadline logs the unfinished work shortly before the deadline of ctx,
+// Lambda kills a timed out invocation without a word
+func watchDeadline(ctx context.Context, work *inflightWork) (stop func()) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return func() {}
+	}
+
+	timer := time.AfterFunc(time.Until(deadline.Add(-deadlineReserve)), func() {
+		pending := work.pending(time.Now())
+		if len(pending) == 0 {
+			return
+		}
+
+		log.Printf("Invocation times out in %s, incomplete: %s", deadlineReserve,
+			strings.Join(pending, "; "))
+	})
+
+	return func() { timer.Stop() }
+}
+
+// whether the time left is down to the reserve
+func nearDeadline(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) <= deadlineReserve
+}
+
+type reserveKey struct{}
+
+// withReserve marks ctx as the work the reserve is kept for, its calls may
+// run until the deadline itself
+func withReserve(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reserveKey{}, true)
+}
+
+// callContext limits a single outbound call to what is left of the deadline,
+// less the reserve, and at most maxCallTimeout
+func callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := maxCallTimeout
+
+	reserve := deadlineReserve
+	if ctx.Value(reserveKey{}) != nil {
+		reserve = 0
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline) - reserve; remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+type callDoneKey struct{}
+
+// limitAWSRequests gives every request of a session its own timeout and
+// tracks it as inflight work, the WithContext API variants pass the
+// invocation context in
+func limitAWSRequests(handlers *request.Handlers) {
+	handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "pipeline-monitor.CallTimeout",
+		Fn: func(r *request.Request) {
+			// presigned URLs are built but never sent
+			if r.IsPresigned() {
+				return
+			}
+
+			done := trackWork(r.Context(), r.ClientInfo.ServiceName+"."+r.Operation.Name)
+
+			ctx, cancel := callContext(r.Context())
+			r.SetContext(context.WithValue(ctx, callDoneKey{}, func() {
+				cancel()
+				done()
+			}))
+		},
+	})
+
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "pipeline-monitor.CallDone",
+		Fn: func(r *request.Request) {
+			done, ok := r.Context().Value(callDoneKey{}).(func())
+			if !ok {
+				return
+			}
+
+			// the caller reads a GetObject body after the call returns, like
+			// deadlineTransport the timeout ends when the body is closed
+			if object, ok := r.Data.(*s3.GetObjectOutput); ok && r.Error == nil && object.Body != nil {
+				object.Body = callBody{ReadCloser: object.Body, done: done}
+				return
+			}
+
+			done()
+		},
+	})
+}
+
+// deadlineTransport does the same for GitHub calls. The timeout has to last
+// until go-github has read the response, so it ends when the body is closed.
+type deadlineTransport struct {
+	base http.RoundTripper
+}
+
+type callBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b callBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+
+	return err
+}
+
+func (t deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done := trackWork(req.Context(), "GitHub "+req.Method+" "+req.URL.Path)
+
+	ctx, cancel := callContext(req.Context())
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		done()
+
+		return resp, err
+	}
+
+	resp.Body = callBody{ReadCloser: resp.Body, done: func() {
+		cancel()
+		done()
+	}}
+
+	return resp, nil
+}
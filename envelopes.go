@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SQS partial batch response, only the listed records are retried
+// https://docs.aws.amazon.com/lambda/latest/dg/with-sqs.html#services-sqs-batchfailurereporting
+type batchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+type batchResponse struct {
+	BatchItemFailures []batchItemFailure `json:"batchItemFailures"`
+}
+
+// CodeStar Notifications deliver the same detail as EventBridge, but with
+// camelCase keys on the outer structure
+// https://docs.aws.amazon.com/dtconsole/latest/userguide/concepts.html
+type codeStarNotification struct {
+	Account             string          `json:"account"`
+	DetailType          string          `json:"detailType"`
+	Region              string          `json:"region"`
+	Source              string          `json:"source"`
+	Time                time.Time       `json:"time"`
+	NotificationRuleArn string          `json:"notificationRuleArn"`
+	Resources           []string        `json:"resources"`
+	Detail              json.RawMessage `json:"detail"`
+}
+
+// just enough of every supported envelope to tell them apart
+type envelopeProbe struct {
+	Records []map[string]interface{} `json:"Records"`
+	Type    string                   `json:"Type"`
+	Message string                   `json:"Message"`
+	// CodeStar Notifications
+	NotificationRuleArn string `json:"notificationRuleArn"`
+}
+
+// unwrap a single payload down to the EventBridge event inside it, the
+// payload may be the event itself, an SNS notification or a CodeStar
+// notification
+func unwrapEvent(payload []byte) (events.CloudWatchEvent, error) {
+	var event events.CloudWatchEvent
+
+	var probe envelopeProbe
+
+	err := json.Unmarshal(payload, &probe)
+	if err != nil {
+		return event, malformedEvent("unable to unmarshal event payload: %s", err)
+	}
+
+	switch {
+	case probe.Type == "Notification" && probe.Message != "":
+		// SNS delivered to SQS without raw message delivery
+		return unwrapEvent([]byte(probe.Message))
+	case probe.NotificationRuleArn != "":
+		var notification codeStarNotification
+
+		err = json.Unmarshal(payload, &notification)
+		if err != nil {
+			return event, malformedEvent("unable to unmarshal CodeStar notification: %s", err)
+		}
+
+		event = events.CloudWatchEvent{
+			DetailType: notification.DetailType,
+			Source:     notification.Source,
+			AccountID:  notification.Account,
+			Time:       notification.Time,
+			Region:     notification.Region,
+			Resources:  notification.Resources,
+			Detail:     notification.Detail,
+		}
+	default:
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			return event, malformedEvent("unable to unmarshal CloudWatch event: %s", err)
+		}
+	}
+
+	if event.DetailType == "" || len(event.Detail) == 0 {
+		return event, malformedEvent("unrecognized event payload, missing detail-type or detail")
+	}
+
+	return event, nil
+}
+
+func handleSQSEvent(ctx context.Context, payload []byte) (batchResponse, error) {
+	response := batchResponse{BatchItemFailures: []batchItemFailure{}}
+
+	var batch events.SQSEvent
+
+	err := json.Unmarshal(payload, &batch)
+	if err != nil {
+		return response, fmt.Errorf("unable to unmarshal SQS event: %s", err)
+	}
+
+	for _, record := range batch.Records {
+		// SQS delivers unstarted messages again, which beats being cut off by
+		// the timeout halfway through one
+		if nearDeadline(ctx) {
+			log.Printf("Leaving SQS message %s for a retry, the invocation is about to time out", record.MessageId)
+
+			response.BatchItemFailures = append(response.BatchItemFailures,
+				batchItemFailure{ItemIdentifier: record.MessageId})
+
+			continue
+		}
+
+		event, err := unwrapEvent([]byte(record.Body))
+		if err == nil {
+			err = handleCloudWatchEvent(ctx, event)
+		}
+
+		if isMalformedEvent(err) {
+			// report success so that SQS drops the message, it can never succeed
+			log.Printf("Dropping malformed SQS message %s: %s", record.MessageId, err)
+		} else if err != nil {
+			log.Printf("Error processing SQS message %s: %s", record.MessageId, err)
+
+			response.BatchItemFailures = append(response.BatchItemFailures,
+				batchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+
+	return response, nil
+}
+
+func handleSNSEvent(ctx context.Context, payload []byte) error {
+	var notification events.SNSEvent
+
+	err := json.Unmarshal(payload, &notification)
+	if err != nil {
+		return fmt.Errorf("unable to unmarshal SNS event: %s", err)
+	}
+
+	var failures []string
+
+	for _, record := range notification.Records {
+		event, err := unwrapEvent([]byte(record.SNS.Message))
+		if err == nil {
+			err = handleCloudWatchEvent(ctx, event)
+		}
+
+		if isMalformedEvent(err) {
+			log.Printf("Dropping malformed SNS message %s: %s", record.SNS.MessageID, err)
+		} else if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", record.SNS.MessageID, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("error processing SNS messages: %s", strings.Join(failures, ", "))
+	}
+
+	return nil
+}
+
+// HandleRequest is the main entry point for the lambda processing. Events may
+// arrive directly from EventBridge, or wrapped in SQS batches or SNS
+// notifications.
+func HandleRequest(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	// one batch of audit entries per invocation, written in the reserve
+	defer auditLog.flush(ctx)
+
+	ctx, work := withInflightWork(ctx)
+	stop := watchDeadline(ctx, work)
+
+	defer stop()
+
+	ctx, span := startInvocationSpan(ctx)
+
+	result, err := handlePayload(ctx, payload)
+
+	span.finish(err)
+	tracer.flush()
+
+	return result, err
+}
+
+func handlePayload(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var probe envelopeProbe
+
+	err := json.Unmarshal(payload, &probe)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal Lambda payload: %s", err)
+	}
+
+	if len(probe.Records) > 0 {
+		switch {
+		case probe.Records[0]["eventSource"] == "aws:sqs":
+			return handleSQSEvent(ctx, payload)
+		case probe.Records[0]["EventSource"] == "aws:sns":
+			return nil, handleSNSEvent(ctx, payload)
+		}
+	}
+
+	event, err := unwrapEvent(payload)
+	if err == nil {
+		err = handleCloudWatchEvent(ctx, event)
+	}
+
+	if isMalformedEvent(err) {
+		// returning an error would make lambda retry an event that can't succeed
+		log.Printf("Dropping malformed event: %s", err)
+		return nil, nil
+	}
+
+	return nil, err
+}
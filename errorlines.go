@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// lines of context shown around every likely error
+const errorContextLines = 2
+
+// lines that usually explain why a build failed, repos can add their own
+// with error_patterns
+var builtinErrorPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\bFAIL\b`),
+	regexp.MustCompile(`(?i)\berror:`),
+	regexp.MustCompile(`\bpanic:`),
+	regexp.MustCompile(`npm ERR!`),
+	regexp.MustCompile(`^Traceback \(most recent call last\)`),
+	regexp.MustCompile(`\[Container\] .*Command did not exit successfully .*exit status [1-9]`),
+}
+
+// errorExcerpt is a run of log lines around one or more matches, overlapping
+// context is merged so no line is shown twice
+type errorExcerpt struct {
+	start   int // 1-based line number of lines[0]
+	lines   []string
+	matches map[int]bool
+}
+
+// findErrorLines returns up to max matching lines with their context. Line
+// numbers count from the start of the retrieved log.
+func findErrorLines(logBody string, patterns []*regexp.Regexp, max, context int) []errorExcerpt {
+	if max <= 0 {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimRight(logBody, "\n"), "\n")
+
+	var excerpts []errorExcerpt
+
+	found := 0
+
+	for i := 0; i < len(lines) && found < max; i++ {
+		if !matchesAny(lines[i], patterns) {
+			continue
+		}
+
+		found++
+
+		from, to := i-context, i+context+1
+		if from < 0 {
+			from = 0
+		}
+
+		if to > len(lines) {
+			to = len(lines)
+		}
+
+		if n := len(excerpts); n > 0 {
+			last := &excerpts[n-1]
+
+			if end := last.start - 1 + len(last.lines); end >= from {
+				if to > end {
+					last.lines = append(last.lines, lines[end:to]...)
+				}
+
+				last.matches[i+1] = true
+
+				continue
+			}
+		}
+
+		excerpts = append(excerpts, errorExcerpt{
+			start:   from + 1,
+			lines:   append([]string(nil), lines[from:to]...),
+			matches: map[int]bool{i + 1: true},
+		})
+	}
+
+	return excerpts
+}
+
+func matchesAny(line string, patterns []*regexp.Regexp) bool {
+	for _, re := range patterns {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatted like grep -n -C, matches are "12:" and context is "12-". Only the
+// last limit lines of a long log are retrieved, offset lines before them
+// make the numbers those of the full log. When the store doesn't say how many
+// lines it skipped the heading says the numbers count from the retrieved tail.
+func formatErrorLines(excerpts []errorExcerpt, limit, offset int) string {
+	if len(excerpts) == 0 {
+		return ""
+	}
+
+	var block strings.Builder
+
+	if offset == unknownOffset {
+		offset = 0
+
+		fmt.Fprintf(&block, "**Likely errors**, line numbers count from the first of the latest %d lines\n\n```\n", limit)
+	} else {
+		block.WriteString("**Likely errors**\n\n```\n")
+	}
+
+	for i, excerpt := range excerpts {
+		if i > 0 {
+			block.WriteString("--\n")
+		}
+
+		for j, line := range excerpt.lines {
+			number := excerpt.start + j
+			separator := "-"
+
+			if excerpt.matches[number] {
+				separator = ":"
+			}
+
+			fmt.Fprintf(&block, "%d%s%s\n", offset+number, separator, strings.TrimRight(line, "\r"))
+		}
+	}
+
+	block.WriteString("```\n")
+
+	return block.String()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// malformedEventError marks events that can never be processed, retrying
+// them would only fail the same way again
+type malformedEventError struct {
+	reason string
+}
+
+func (e *malformedEventError) Error() string {
+	return e.reason
+}
+
+func malformedEvent(format string, args ...interface{}) error {
+	return &malformedEventError{reason: fmt.Sprintf(format, args...)}
+}
+
+func isMalformedEvent(err error) bool {
+	var malformed *malformedEventError
+	return errors.As(err, &malformed)
+}
+
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/events/EventTypes.html#codepipeline_event_type
+type codePipelineActionDetail struct {
+	Pipeline    string `json:"pipeline"`
+	ExecutionID string `json:"execution-id"`
+	Stage       string `json:"stage"`
+	Action      string `json:"action"`
+	State       string `json:"state"`
+	Region      string `json:"region"`
+}
+
+func (d *codePipelineActionDetail) validate() error {
+	return requireFields(map[string]string{
+		"pipeline":     d.Pipeline,
+		"execution-id": d.ExecutionID,
+		"stage":        d.Stage,
+		"action":       d.Action,
+		"state":        d.State,
+	})
+}
+
+type codePipelineExecutionDetail struct {
+	Pipeline    string `json:"pipeline"`
+	ExecutionID string `json:"execution-id"`
+	State       string `json:"state"`
+}
+
+func (d *codePipelineExecutionDetail) validate() error {
+	return requireFields(map[string]string{
+		"pipeline":     d.Pipeline,
+		"execution-id": d.ExecutionID,
+		"state":        d.State,
+	})
+}
+
+// https://docs.aws.amazon.com/codebuild/latest/userguide/sample-build-notifications.html
+type codeBuildStateDetail struct {
+	BuildStatus  string `json:"build-status"`
+	ProjectName  string `json:"project-name"`
+	BuildID      string `json:"build-id"`
+	CurrentPhase string `json:"current-phase"`
+}
+
+func (d *codeBuildStateDetail) validate() error {
+	return requireFields(map[string]string{
+		"project-name":  d.ProjectName,
+		"build-id":      d.BuildID,
+		"current-phase": d.CurrentPhase,
+	})
+}
+
+type eventDetail interface {
+	validate() error
+}
+
+func requireFields(fields map[string]string) error {
+	var missing []string
+
+	for name, value := range fields {
+		if value == "" {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		// map iteration order is random, keep the message stable
+		sort.Strings(missing)
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// unmarshal and validate the event detail, any failure here is permanent
+func decodeDetail(request events.CloudWatchEvent, detail eventDetail) error {
+	err := json.Unmarshal(request.Detail, detail)
+	if err != nil {
+		return malformedEvent("unable to unmarshal %s detail: %s", request.DetailType, err)
+	}
+
+	err = detail.validate()
+	if err != nil {
+		return malformedEvent("invalid %s detail in event %s: %s", request.DetailType, request.ID, err)
+	}
+
+	return nil
+}
+
+type eventHandler func(ctx context.Context, request events.CloudWatchEvent) error
+
+// eventHandlers maps the EventBridge detail-type to the processor for it,
+// new event types only need an entry here
+var eventHandlers = map[string]eventHandler{
+	"CodePipeline Action Execution State Change":   processCodePipelineNotification,
+	"CodePipeline Pipeline Execution State Change": processPipelineExecutionNotification,
+	"CodeBuild Build State Change":                 processCodeBuildNotification, // these come from PR builds
+	"Scheduled Event":                              processScheduledEvent,
+	"GitHub check_run":                             processCheckRunWebhook, // from the /github endpoint of serve
+}
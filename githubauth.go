@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+const publicGitHubHost = "github.com"
+
+// gitHubCredential is either a token, or a GitHub App installation that
+// mints short lived tokens
+type gitHubCredential struct {
+	Token string `json:"token"`
+
+	AppID          int64  `json:"app_id"`
+	InstallationID int64  `json:"installation_id"`
+	PrivateKey     string `json:"private_key"`
+}
+
+// the secret in SECRETSMANAGER_GITHUBTOKEN_NAME. A lone token is used for
+// every owner on github.com, owners can have their own credentials keyed by
+// "owner" for github.com or "host/owner" for GitHub Enterprise.
+//
+//	{
+//	  "token": "default token",
+//	  "owners": {
+//	    "kindlyops": {"token": "..."},
+//	    "github.example.com/platform": {"app_id": 1, "installation_id": 2, "private_key": "-----BEGIN..."}
+//	  }
+//	}
+type gitHubCredentials struct {
+	Token  string                      `json:"token"`
+	Owners map[string]gitHubCredential `json:"owners"`
+}
+
+func parseGitHubCredentials(secret []byte) (gitHubCredentials, error) {
+	var credentials gitHubCredentials
+
+	err := json.Unmarshal(secret, &credentials)
+	if err != nil {
+		return credentials, fmt.Errorf("unable to unmarshal GitHub credentials: %s", err)
+	}
+
+	if credentials.Token == "" && len(credentials.Owners) == 0 {
+		return credentials, fmt.Errorf("GitHub credentials have neither a token nor owners")
+	}
+
+	for key, credential := range credentials.Owners {
+		if credential.Token != "" {
+			continue
+		}
+
+		if credential.AppID == 0 || credential.InstallationID == 0 || credential.PrivateKey == "" {
+			return credentials, fmt.Errorf("GitHub credential for %s needs a token or app_id, installation_id and "+
+				"private_key", key)
+		}
+
+		if _, err = parseAppPrivateKey(credential.PrivateKey); err != nil {
+			return credentials, fmt.Errorf("GitHub credential for %s: %s", key, err)
+		}
+	}
+
+	return credentials, nil
+}
+
+// lookup returns the credential for a repo owner and the key it is stored
+// under, which also identifies the client built from it
+func (c gitHubCredentials) lookup(host, owner string) (string, gitHubCredential, error) {
+	if host == "" {
+		host = publicGitHubHost
+	}
+
+	key := host + "/" + owner
+	if credential, ok := c.Owners[key]; ok {
+		return key, credential, nil
+	}
+
+	if host == publicGitHubHost {
+		if credential, ok := c.Owners[owner]; ok {
+			return key, credential, nil
+		}
+
+		if c.Token != "" {
+			return publicGitHubHost, gitHubCredential{Token: c.Token}, nil
+		}
+	}
+
+	// retrying won't make a credential appear, so the event is dropped
+	return "", gitHubCredential{}, malformedEvent("no GitHub credential configured for %s", key)
+}
+
+func parseAppPrivateKey(privateKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, fmt.Errorf("private_key is not PEM encoded")
+	}
+
+	// GitHub hands out PKCS#1 keys, converted keys are often PKCS#8
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private_key: %s", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private_key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// the JWT a GitHub App signs to ask for installation tokens
+// https://docs.github.com/en/developers/apps/authenticating-with-github-apps
+func appJWT(appID int64, key *rsa.PrivateKey, now time.Time) (string, error) {
+	encode := func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b), err
+	}
+
+	header, err := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	// backdated to allow for clock drift, GitHub allows at most 10 minutes
+	claims, err := encode(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256([]byte(header + "." + claims))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// appTokenSource exchanges the app JWT for an installation token, wrapped
+// in oauth2.ReuseTokenSource it only does so when the token expires
+type appTokenSource struct {
+	host       string
+	credential gitHubCredential
+}
+
+func (s appTokenSource) Token() (*oauth2.Token, error) {
+	key, err := parseAppPrivateKey(s.credential.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	jwt, err := appJWT(s.credential.AppID, key, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign app JWT: %s", err)
+	}
+
+	// oauth2 asks for tokens without the context of the call that needs one
+	ctx, cancel := callContext(context.Background())
+	defer cancel()
+
+	app, err := newGitHubClient(ctx, s.host, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: jwt}))
+	if err != nil {
+		return nil, err
+	}
+
+	// the installations/{id}/access_tokens endpoint in this go-github is gone
+	u := fmt.Sprintf("app/installations/%d/access_tokens", s.credential.InstallationID)
+
+	req, err := app.NewRequest("POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var token github.InstallationToken
+
+	_, err = app.Do(ctx, req, &token)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create installation token for app %d: %s", s.credential.AppID, err)
+	}
+
+	return &oauth2.Token{AccessToken: token.GetToken(), Expiry: token.GetExpiresAt()}, nil
+}
+
+var gitHubClients = struct {
+	sync.Mutex
+	clients map[string]*github.Client
+}{clients: make(map[string]*github.Client)}
+
+// getGitHubClient returns the client for a repo owner, created on first use
+// and shared by later invocations like the AWS clients
+func getGitHubClient(host, owner string) (*github.Client, error) {
+	key, credential, err := gitHubCredentialSet.lookup(host, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	gitHubClients.Lock()
+	defer gitHubClients.Unlock()
+
+	if client, ok := gitHubClients.clients[key]; ok {
+		return client, nil
+	}
+
+	apiHost := strings.SplitN(key, "/", 2)[0]
+
+	var ts oauth2.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: credential.Token})
+	if credential.Token == "" {
+		ts = oauth2.ReuseTokenSource(nil, appTokenSource{host: apiHost, credential: credential})
+	}
+
+	client, err := newGitHubClient(context.Background(), apiHost, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	gitHubClients.clients[key] = client
+
+	return client, nil
+}
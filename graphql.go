@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// go-github only speaks REST, the few GraphQL-only features we need go
+// through the same client so they share its token and transport
+// https://docs.github.com/en/graphql/guides/forming-calls-with-graphql
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// REST lives at https://host/api/v3/ on GitHub Enterprise while GraphQL is
+// at https://host/api/graphql, github.com serves both from api.github.com
+func graphQLEndpoint(gh *github.Client) string {
+	if strings.HasSuffix(gh.BaseURL.Path, "/api/v3/") {
+		return strings.TrimSuffix(gh.BaseURL.Path, "v3/") + "graphql"
+	}
+
+	return "graphql"
+}
+
+func graphQL(ctx context.Context, gh *github.Client, query string, variables map[string]interface{},
+	data interface{}) error {
+	req, err := gh.NewRequest("POST", graphQLEndpoint(gh), graphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		return err
+	}
+
+	var resp graphQLResponse
+
+	_, err = gh.Do(ctx, req, &resp)
+	if err != nil {
+		return err
+	}
+
+	// GraphQL reports most failures with a 200 and a list of errors
+	if len(resp.Errors) > 0 {
+		messages := make([]string, len(resp.Errors))
+		for i, e := range resp.Errors {
+			messages[i] = e.Message
+		}
+
+		return fmt.Errorf("graphql: %s", strings.Join(messages, "; "))
+	}
+
+	if data == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Data, data)
+}
+
+const minimizedCommentsQuery = `query($ids: [ID!]!) {
+  nodes(ids: $ids) {
+    ... on IssueComment { id isMinimized }
+  }
+}`
+
+const minimizeCommentMutation = `mutation($id: ID!) {
+  minimizeComment(input: {subjectId: $id, classifier: OUTDATED}) {
+    minimizedComment { isMinimized }
+  }
+}`
+
+// hide comments as outdated, skipping the ones that already are so that
+// every new build only minimizes the comment it replaces
+func minimizeComments(ctx context.Context, gh *github.Client, nodeIDs []string) error {
+	if len(nodeIDs) == 0 {
+		return nil
+	}
+
+	var state struct {
+		Nodes []struct {
+			ID          string `json:"id"`
+			IsMinimized bool   `json:"isMinimized"`
+		} `json:"nodes"`
+	}
+
+	err := graphQL(ctx, gh, minimizedCommentsQuery, map[string]interface{}{"ids": nodeIDs}, &state)
+	if err != nil {
+		return fmt.Errorf("unable to query comments: %s", err)
+	}
+
+	for _, node := range state.Nodes {
+		if node.ID == "" || node.IsMinimized {
+			continue
+		}
+
+		err = graphQL(ctx, gh, minimizeCommentMutation, map[string]interface{}{"id": node.ID}, nil)
+		if err != nil {
+			return fmt.Errorf("unable to minimize comment %s: %s", node.ID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// enough for a large test suite, bigger files are most likely not reports
+	maxJUnitReportSize = 10 * 1024 * 1024
+	maxJUnitReports    = 20
+)
+
+// the root element is <testsuites> or a single <testsuite>, both decode here
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure"`
+	Error     *junitProblem `xml:"error"`
+	Skipped   *struct{}     `xml:"skipped"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func parseJUnitReport(r io.Reader) (testReport, error) {
+	var root junitSuite
+
+	err := xml.NewDecoder(r).Decode(&root)
+	if err != nil {
+		return testReport{}, fmt.Errorf("unable to parse JUnit XML: %s", err)
+	}
+
+	var report testReport
+
+	addJUnitSuite(&report, root)
+
+	return report, nil
+}
+
+func addJUnitSuite(report *testReport, suite junitSuite) {
+	for _, nested := range suite.Suites {
+		addJUnitSuite(report, nested)
+	}
+
+	for _, c := range suite.Cases {
+		name := c.Name
+		if c.ClassName != "" {
+			name = c.ClassName + "." + c.Name
+		}
+
+		report.timings = append(report.timings, testTiming{name: name, duration: parseSeconds(c.Time)})
+
+		problem := c.Failure
+		if problem == nil {
+			problem = c.Error
+		}
+
+		switch {
+		case problem != nil:
+			report.failed++
+
+			lines := strings.Split(strings.TrimSpace(problem.Text), "\n")
+			if problem.Message != "" {
+				lines = append([]string{problem.Message}, lines...)
+			}
+
+			report.failures = append(report.failures, testFailure{Name: name, Message: trimFailureMessage(lines)})
+		case c.Skipped != nil:
+			report.skipped++
+		default:
+			report.passed++
+		}
+	}
+}
+
+func matchesAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadJUnitReports reads the files of unpackaged artifacts that match the
+// junit_reports patterns of the repo config, relative to the artifact.
+// Reports that can't be read are logged and left out.
+func loadJUnitReports(ctx context.Context, svc *s3.S3, artifacts []*codebuild.BuildArtifacts,
+	patterns []string) testReport {
+	var report testReport
+
+	loaded := 0
+
+	for _, artifact := range artifacts {
+		location := aws.StringValue(artifact.Location)
+		if location == "" || strings.HasSuffix(location, ".zip") {
+			// zipped artifacts would have to be downloaded whole
+			continue
+		}
+
+		bucket, prefix, err := parseArtifactLocation(location)
+		if err != nil {
+			log.Printf("Skipping JUnit reports in %s: %s", location, err)
+			continue
+		}
+
+		list, err := svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix + "/"),
+		})
+		if err != nil {
+			log.Printf("Unable to list JUnit reports in %s: %s", location, err)
+			continue
+		}
+
+		for _, object := range list.Contents {
+			key := aws.StringValue(object.Key)
+			if loaded == maxJUnitReports || aws.Int64Value(object.Size) > maxJUnitReportSize ||
+				!matchesAnyGlob(patterns, strings.TrimPrefix(key, prefix+"/")) {
+				continue
+			}
+
+			loaded++
+
+			found, err := loadJUnitReport(ctx, svc, bucket, key)
+			if err != nil {
+				log.Printf("Skipping JUnit report s3://%s/%s: %s", bucket, key, err)
+				continue
+			}
+
+			report.add(found)
+		}
+	}
+
+	return report
+}
+
+func loadJUnitReport(ctx context.Context, svc *s3.S3, bucket, key string) (testReport, error) {
+	resp, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return testReport{}, err
+	}
+	defer resp.Body.Close()
+
+	return parseJUnitReport(io.LimitReader(resp.Body, maxJUnitReportSize))
+}
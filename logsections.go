@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fields are exported so that the comment template can read them
+type logSection struct {
+	Name    string
+	Body    string
+	Lines   int
+	Omitted int
+	Open    bool
+}
+
+// CodeBuild marks phase transitions in the log with lines like
+// "[Container] 2020/06/01 17:01:02 Entering phase BUILD"
+var phaseMarker = regexp.MustCompile(`\[Container\] .*Entering phase (?P<phase>\w+)`)
+
+func getMaxPhaseLogLines() int {
+	i, err := strconv.Atoi(os.Getenv("MAX_PHASE_LOG_LINES"))
+	if err != nil || i <= 0 || i > maxLogLines {
+		i = 500
+	}
+
+	return i
+}
+
+func newLogSection(name string, lines []string, budget int, fromHead, open bool) logSection {
+	section := logSection{
+		Name:  name,
+		Lines: len(lines),
+		Open:  open,
+	}
+
+	if len(lines) > budget {
+		section.Omitted = len(lines) - budget
+
+		if fromHead {
+			lines = lines[:budget]
+		} else {
+			lines = lines[section.Omitted:]
+		}
+	}
+
+	section.Body = strings.Join(lines, "\n")
+
+	return section
+}
+
+// pick the lines that go in the comment according to the excerpt strategy
+// from the repo config
+func excerptLog(logBody, strategy string, budget int, failedPhases map[string]bool) []logSection {
+	if strategy == excerptPhases {
+		return splitLogSections(logBody, budget, failedPhases)
+	}
+
+	if logBody == "" {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimRight(logBody, "\n"), "\n")
+
+	return []logSection{newLogSection("LOG", lines, budget, strategy == excerptHead, len(failedPhases) > 0)}
+}
+
+// split the raw log into one section per CodeBuild phase, keeping only the
+// last budget lines of each section because errors show up at the end
+func splitLogSections(logBody string, budget int, failedPhases map[string]bool) []logSection {
+	var sections []logSection
+
+	if logBody == "" {
+		return sections
+	}
+
+	var lines []string
+
+	name := "SETUP"
+
+	flush := func() {
+		if len(lines) == 0 {
+			return
+		}
+
+		sections = append(sections, newLogSection(name, lines, budget, false, failedPhases[name]))
+		lines = nil
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(logBody, "\n"), "\n") {
+		if match := phaseMarker.FindStringSubmatch(line); match != nil {
+			flush()
+
+			name = match[1]
+		}
+
+		lines = append(lines, line)
+	}
+
+	flush()
+
+	return sections
+}
+
+func failedPhaseNames(summary buildSummary) map[string]bool {
+	failed := make(map[string]bool)
+
+	for _, p := range summary.phases {
+		if p.failed() {
+			failed[p.name] = true
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// a logSource is wherever a project ships its build logs, CloudWatch Logs,
+// S3 or both
+type logSource interface {
+	// the last limit lines of the log, and how many lines came before them
+	// or unknownOffset when the store can't tell
+	fetch(ctx context.Context, limit int) (string, int, error)
+	// a human name for the store, used in the comment
+	name() string
+	// the console page for the full log
+	deepLink() string
+}
+
+type cloudWatchLogSource struct {
+	svc        *cloudwatchlogs.CloudWatchLogs
+	groupName  string
+	streamName string
+	link       string
+}
+
+// lines skipped before the tail of a log, for stores that only return the tail
+const unknownOffset = -1
+
+// GetLogEvents returns the latest events without saying how many came before
+func (c cloudWatchLogSource) fetch(ctx context.Context, limit int) (string, int, error) {
+	resp, err := c.svc.GetLogEventsWithContext(ctx, &cloudwatchlogs.GetLogEventsInput{
+		Limit:         aws.Int64(int64(limit)),
+		LogGroupName:  aws.String(c.groupName),
+		LogStreamName: aws.String(c.streamName),
+	})
+
+	if err != nil {
+		return "", unknownOffset, err
+	}
+
+	var body strings.Builder
+
+	for _, event := range resp.Events {
+		body.WriteString(aws.StringValue(event.Message))
+	}
+
+	return body.String(), unknownOffset, nil
+}
+
+func (c cloudWatchLogSource) name() string {
+	return "cloudwatch"
+}
+
+func (c cloudWatchLogSource) deepLink() string {
+	return c.link
+}
+
+type s3LogSource struct {
+	svc    *s3.S3
+	bucket string
+	key    string
+	link   string
+}
+
+// the whole object is read to find its tail, so the lines before it are known
+func (s s3LogSource) fetch(ctx context.Context, limit int) (string, int, error) {
+	resp, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		return "", unknownOffset, err
+	}
+	defer resp.Body.Close()
+
+	body, err := decompressLog(resp.Body)
+	if err != nil {
+		return "", unknownOffset, fmt.Errorf("unable to read s3://%s/%s: %s", s.bucket, s.key, err)
+	}
+
+	return tailLines(body, limit)
+}
+
+func (s s3LogSource) name() string {
+	return "S3"
+}
+
+func (s s3LogSource) deepLink() string {
+	return s.link
+}
+
+// both sources return at most limit lines, a log that fills them most likely
+// started earlier
+func logTruncated(log string, limit int) bool {
+	return strings.Count(log, "\n") >= limit
+}
+
+// CodeBuild gzips the logs it writes to S3 unless encryption is disabled,
+// so look at the content rather than trusting the key
+func decompressLog(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return buffered, nil
+	}
+
+	return gzip.NewReader(buffered)
+}
+
+// the last limit lines of r and the number of lines before them, matching
+// what GetLogEvents returns without reading whole multi-megabyte logs into
+// memory
+func tailLines(r io.Reader, limit int) (string, int, error) {
+	lines := make([]string, 0, limit)
+	next := 0
+	skipped := 0
+
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadString('\n')
+		switch {
+		case line == "":
+		case len(lines) < limit:
+			lines = append(lines, line)
+		case limit > 0:
+			lines[next] = line
+			next = (next + 1) % limit
+			skipped++
+		default:
+			skipped++
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return "", unknownOffset, err
+		}
+	}
+
+	return strings.Join(append(lines[next:], lines[:next]...), ""), skipped, nil
+}
+
+// S3 log locations are "bucket/prefix" or "arn:aws:s3:::bucket/prefix", and
+// each build writes <prefix>/<build uuid>.gz
+func s3LogObject(location, buildID string) (bucket, key string, err error) {
+	location = strings.TrimPrefix(location, "arn:aws:s3:::")
+
+	parts := strings.SplitN(location, "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("unexpected S3 log location %s", location)
+	}
+
+	buildUUID := buildID[strings.LastIndex(buildID, ":")+1:]
+
+	key = buildUUID + ".gz"
+	if len(parts) == 2 && strings.Trim(parts[1], "/") != "" {
+		key = strings.Trim(parts[1], "/") + "/" + key
+	}
+
+	return parts[0], key, nil
+}
+
+// prefer CloudWatch when the project logs to both, it is cheaper to read
+// just the tail of a stream
+func newLogSource(clients *awsClients, build *codebuild.Build) (logSource, error) {
+	logs := build.Logs
+	if logs == nil {
+		return nil, fmt.Errorf("build %s has no logs", aws.StringValue(build.Id))
+	}
+
+	cloudWatchEnabled := logs.CloudWatchLogs == nil ||
+		aws.StringValue(logs.CloudWatchLogs.Status) == codebuild.LogsConfigStatusTypeEnabled
+	if cloudWatchEnabled && logs.GroupName != nil && logs.StreamName != nil {
+		return cloudWatchLogSource{
+			svc:        clients.cloudWatchLogs,
+			groupName:  aws.StringValue(logs.GroupName),
+			streamName: aws.StringValue(logs.StreamName),
+			link:       aws.StringValue(logs.DeepLink),
+		}, nil
+	}
+
+	if logs.S3Logs != nil && aws.StringValue(logs.S3Logs.Status) == codebuild.LogsConfigStatusTypeEnabled {
+		bucket, key, err := s3LogObject(aws.StringValue(logs.S3Logs.Location), aws.StringValue(build.Id))
+		if err != nil {
+			return nil, err
+		}
+
+		return s3LogSource{
+			svc:    clients.s3,
+			bucket: bucket,
+			key:    key,
+			link:   aws.StringValue(logs.S3DeepLink),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("build %s has neither CloudWatch nor S3 logs", aws.StringValue(build.Id))
+}
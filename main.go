@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -17,6 +18,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/codebuild"
 	"github.com/aws/aws-sdk-go/service/codepipeline"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 
@@ -24,14 +26,17 @@ import (
 	"golang.org/x/oauth2"
 )
 
-// load the GitHub Oauth token when the lambda is loaded, not on every execution
+// load the GitHub credentials when the lambda is loaded, not on every execution
 // this reduces the call volume into SecretsManager
-var gitHubToken string
+var gitHubCredentialSet gitHubCredentials
 var maxLogLines int
-
-type secretToken struct {
-	Token string `json:"token"`
-}
+var maxPhaseLogLines int
+var prices priceTable
+var artifactProjects map[string]bool
+var artifactLinkExpiry time.Duration
+var stuckScanPipelines []string
+var notificationSinks []notificationSink
+var routingRules []routingRule
 
 func getMaxLogLines() int {
 	i, err := strconv.Atoi(os.Getenv("MAX_LOG_LINES"))
@@ -41,38 +46,36 @@ func getMaxLogLines() int {
 	return i
 }
 
-func getGitHubToken() (string, error) {
+func getGitHubCredentials() (gitHubCredentials, error) {
 	secretName := os.Getenv("SECRETSMANAGER_GITHUBTOKEN_NAME")
 	if secretName == "" {
 		err := fmt.Errorf("couldn't find SECRETSMANAGER_GITHUBTOKEN_NAME in environment")
-		return "", err
+		return gitHubCredentials{}, err
 	}
 
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String(endpoints.UsWest2RegionID),
 	}))
+	traceAWSRequests(&sess.Handlers)
+	limitAWSRequests(&sess.Handlers)
 
 	svc := secretsmanager.New(sess)
 	input := &secretsmanager.GetSecretValueInput{
 		SecretId: aws.String(secretName),
 	}
 
-	result, err := svc.GetSecretValue(input)
+	// loaded before any invocation, so only the call timeout applies
+	ctx, cancel := callContext(context.Background())
+	defer cancel()
 
-	if err != nil {
-		err = fmt.Errorf("unable to retrieve GitHub auth token: %s", err.Error())
-		return "", err
-	}
-
-	var token secretToken
-	err = json.Unmarshal([]byte(*result.SecretString), &token)
+	result, err := svc.GetSecretValueWithContext(ctx, input)
 
 	if err != nil {
-		err = fmt.Errorf("unable to unmarshal secret token: %v", err.Error())
-		return "", err
+		err = fmt.Errorf("unable to retrieve GitHub auth token: %s", err.Error())
+		return gitHubCredentials{}, err
 	}
 
-	return token.Token, nil
+	return parseGitHubCredentials([]byte(aws.StringValue(result.SecretString)))
 }
 
 type executionDetails struct {
@@ -110,6 +113,7 @@ func parseRevisionURL(revisionURL string) (revisionInfo, error) {
 	}
 
 	info := revisionInfo{
+		host:   u.Host,
 		owner:  matches["owner"],
 		repo:   matches["repo"],
 		commit: matches["commit"],
@@ -138,45 +142,138 @@ func translateStatus(status string) string {
 	return actionState
 }
 
-func getRevisionID(input executionDetails) (*revisionInfo, error) {
-	sess := session.Must(session.NewSession())
+func executionTimelineURL(region string, details executionDetails) string {
+	return fmt.Sprintf(
+		"https://%s.console.aws.amazon.com/codesuite/codepipeline/pipelines/%s/executions/%s/timeline",
+		region,
+		details.pipelineName,
+		details.executionID)
+}
+
+// the status context for an action, repos can map action names to labels
+func statusLabelFor(action string, config *repoConfig) string {
+	if label, ok := config.Labels[action]; ok {
+		return label
+	}
+
+	if strings.Contains(action, "-") {
+		// if the action name has a -, split up the label to make it a bit easier
+		// to read in the GitHub web UI
+		parts := strings.Split(action, "-")
+		return fmt.Sprintf("%s for %s", parts[0], parts[1])
+	}
+
+	return action
+}
+
+// GitHub rejects status descriptions longer than 140 characters
+const maxStatusDescription = 140
+
+func truncateDescription(description string) string {
+	runes := []rune(strings.Join(strings.Fields(description), " "))
+	if len(runes) <= maxStatusDescription {
+		return string(runes)
+	}
+
+	return string(runes[:maxStatusDescription-1]) + "…"
+}
+
+// the status for an action in the given event state, before the details of
+// its execution are applied
+func actionStatus(template statusInfo, stage, action, state, region string, config *repoConfig) statusInfo {
+	status := template
+	status.label = statusLabelFor(action, config)
+	status.stage = stage
+	status.action = action
+	status.state = translateStatus(state)
+	status.description = fmt.Sprintf("%s stage executing in %s", stage, region)
+
+	if status.state == "failure" {
+		status.description = fmt.Sprintf("%s stage failed in %s", stage, region)
+	}
+
+	return status
+}
+
+// point the status at whatever ran the action, like the CodeBuild log or the
+// CloudFormation stack, and explain failures with the action's own summary
+// https://docs.aws.amazon.com/codepipeline/latest/APIReference/API_ActionExecutionResult.html
+func applyActionExecution(status *statusInfo, execution *codepipeline.ActionExecutionDetail) {
+	if execution.Output == nil || execution.Output.ExecutionResult == nil {
+		return
+	}
+
+	result := execution.Output.ExecutionResult
+
+	if url := aws.StringValue(result.ExternalExecutionUrl); url != "" {
+		status.url = url
+	}
+
+	if summary := aws.StringValue(result.ExternalExecutionSummary); summary != "" && status.state == "failure" {
+		status.description = truncateDescription(summary)
+	}
+}
+
+// executions never change their source revision, so warm invocations can
+// answer from the cache for the lifetime of a typical deploy
+var revisions = newRevisionCache(1000, time.Hour)
+
+func getRevisionID(ctx context.Context, input executionDetails) (*revisionInfo, error) {
+	key := input.pipelineName + "/" + input.executionID
+
+	return revisions.get(ctx, key, func() (*revisionInfo, error) {
+		return lookupRevisionID(ctx, input)
+	})
+}
 
+func lookupRevisionID(ctx context.Context, input executionDetails) (*revisionInfo, error) {
 	// change this to use an interface so that this can be mocked/tested
 	// https://docs.aws.amazon.com/sdk-for-go/api/service/codepipeline/codepipelineiface/
-	svc := codepipeline.New(sess)
+	svc := getAWSClients().codePipeline
 
 	apiInput := &codepipeline.GetPipelineExecutionInput{
 		PipelineExecutionId: aws.String(input.executionID),
 		PipelineName:        aws.String(input.pipelineName),
 	}
 
-	result, err := svc.GetPipelineExecution(apiInput)
+	result, err := svc.GetPipelineExecutionWithContext(ctx, apiInput)
 
 	if err != nil {
 		err = fmt.Errorf("unable to retrieve Pipeline execution state: %s", err.Error())
 		return nil, err
 	}
 
-	artifacts := result.PipelineExecution.ArtifactRevisions
+	return parseArtifactRevisions(result.PipelineExecution.ArtifactRevisions)
+}
 
-	if count := len(artifacts); count > 1 {
-		err = fmt.Errorf("did not expect multiple CodePipeline artifacts, got: %v", count)
-		return nil, err
+// an execution starts before its source action has recorded the revision
+var errNoRevisionYet = errors.New("no CodePipeline artifact revisions yet")
+
+func parseArtifactRevisions(artifacts []*codepipeline.ArtifactRevision) (*revisionInfo, error) {
+	switch count := len(artifacts); {
+	case count == 0:
+		return nil, errNoRevisionYet
+	case count > 1:
+		return nil, fmt.Errorf("did not expect multiple CodePipeline artifacts, got: %v", count)
 	}
 
 	artifact := artifacts[0]
 
-	info, err := parseRevisionURL(*artifact.RevisionUrl)
+	info, err := parseRevisionURL(aws.StringValue(artifact.RevisionUrl))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse revision URL: %s", err.Error())
+	}
 
-	if err != nil || info.commit != *artifact.RevisionId {
-		err = fmt.Errorf("failed to parse revision URL: %s", err.Error())
-		return nil, err
+	if info.commit != aws.StringValue(artifact.RevisionId) {
+		return nil, fmt.Errorf("revision URL %s does not match revision %s",
+			aws.StringValue(artifact.RevisionUrl), aws.StringValue(artifact.RevisionId))
 	}
 
 	return &info, nil
 }
 
 type statusInfo struct {
+	host        string
 	owner       string
 	repo        string
 	commitID    string
@@ -184,16 +281,28 @@ type statusInfo struct {
 	url         string
 	state       string
 	label       string
+	// the pipeline action the status is for, used by the routing rules
+	stage  string
+	action string
 }
 
-func updateGitHubStatus(status *statusInfo) error {
+func newGitHubClient(ctx context.Context, host string, ts oauth2.TokenSource) (*github.Client, error) {
 	// guidance on auth from https://github.com/google/go-github#authentication
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: gitHubToken},
-	)
 	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
+	tc.Transport = tracingTransport{base: deadlineTransport{base: auditTransport{base: tc.Transport, log: auditLog}}}
+
+	if host == "" || host == publicGitHubHost {
+		return github.NewClient(tc), nil
+	}
+
+	return github.NewEnterpriseClient("https://"+host+"/api/v3/", "https://"+host+"/api/uploads/", tc)
+}
+
+func updateGitHubStatus(ctx context.Context, status *statusInfo) error {
+	client, err := getGitHubClient(status.host, status.owner)
+	if err != nil {
+		return err
+	}
 
 	repoStatus := &github.RepoStatus{}
 	repoStatus.State = &status.state
@@ -201,8 +310,8 @@ func updateGitHubStatus(status *statusInfo) error {
 	repoStatus.Description = &status.description
 	repoStatus.TargetURL = &status.url
 
-	_, _, err := client.Repositories.CreateStatus(
-		context.Background(),
+	_, _, err = client.Repositories.CreateStatus(
+		ctx,
 		status.owner,
 		status.repo,
 		status.commitID,
@@ -216,124 +325,246 @@ func updateGitHubStatus(status *statusInfo) error {
 	return err
 }
 
-func processCodePipelineNotification(request events.CloudWatchEvent, detail map[string]interface{}) error {
+func processCodePipelineNotification(ctx context.Context, request events.CloudWatchEvent) error {
 	// we process Action execution state changes so that we can get granular
 	// status updates on deploys of individual services or stacks
 	log.Printf("Processing %s", request.DetailType)
 
+	var detail codePipelineActionDetail
+
+	err := decodeDetail(request, &detail)
+	if err != nil {
+		return err
+	}
+
 	details := executionDetails{
-		pipelineName: detail["pipeline"].(string),
-		executionID:  detail["execution-id"].(string),
+		pipelineName: detail.Pipeline,
+		executionID:  detail.ExecutionID,
 	}
+	tracePipeline(ctx, details)
 
-	pipelineStatusPage := fmt.Sprintf(
-		"https://%s.console.aws.amazon.com/codesuite/codepipeline/pipelines/%s/executions/%s/timeline",
-		request.Region,
-		details.pipelineName,
-		details.executionID)
+	pipelineStatusPage := executionTimelineURL(request.Region, details)
 
 	// ignore the Source stage (this is the github trigger)
-	if detail["stage"] == "Source" {
+	if detail.Stage == "Source" {
 		log.Printf("Ignoring the Source stage for %s", pipelineStatusPage)
 		return nil
 	}
 
-	log.Printf("Processing the %s stage for %s", detail["stage"], pipelineStatusPage)
+	log.Printf("Processing the %s stage for %s", detail.Stage, pipelineStatusPage)
 
-	revisionInfo, err := getRevisionID(details)
+	revisionInfo, err := getRevisionID(ctx, details)
 
 	if err != nil {
 		log.Printf("Error getting revision ID for %s: %s", pipelineStatusPage, err.Error())
 		return nil
 	}
 
-	actionState := translateStatus(detail["state"].(string))
-	action := detail["action"].(string)
-	statusLabel := action
-	statusDescription := fmt.Sprintf("%s stage executing in %s", detail["stage"], detail["region"])
+	traceRevision(ctx, revisionInfo.host, revisionInfo.owner, revisionInfo.repo, revisionInfo.commit)
 
-	if strings.Contains(action, "-") {
-		// if the action name has a -, split up the label to make it a bit easier
-		// to read in the GitHub web UI
-		parts := strings.Split(action, "-")
-		statusLabel = fmt.Sprintf("%s for %s", parts[0], parts[1])
+	gh, err := getGitHubClient(revisionInfo.host, revisionInfo.owner)
+	if err != nil {
+		return err
 	}
 
-	commitStatus := statusInfo{
-		commitID:    revisionInfo.commit,
-		owner:       revisionInfo.owner,
-		repo:        revisionInfo.repo,
-		url:         pipelineStatusPage,
-		label:       statusLabel,
-		state:       actionState,
-		description: statusDescription,
+	config := loadRepoConfig(ctx, gh, revisionInfo.owner, revisionInfo.repo, revisionInfo.commit)
+
+	if !config.Statuses {
+		log.Printf("Statuses are disabled by %s in %s/%s", repoConfigPath, revisionInfo.owner, revisionInfo.repo)
+		return nil
 	}
 
-	err = updateGitHubStatus(&commitStatus)
+	action := detail.Action
+	commitStatus := actionStatus(statusInfo{
+		host:     revisionInfo.host,
+		commitID: revisionInfo.commit,
+		owner:    revisionInfo.owner,
+		repo:     revisionInfo.repo,
+		url:      pipelineStatusPage,
+	}, detail.Stage, action, detail.State, detail.Region, &config)
+
+	executions, listErr := listActionExecutions(ctx, details)
+	if listErr != nil {
+		// the status still goes out with the generic description and link
+		log.Printf("Error listing action executions for %s: %s", pipelineStatusPage, listErr)
+	}
 
-	if err != nil {
-		log.Printf("error updating GitHub commit status: %s", err.Error())
+	if execution, ok := executions[actionKey(detail.Stage, action)]; ok {
+		applyActionExecution(&commitStatus, execution)
+	}
+
+	target := pipelineTarget(ctx, details.pipelineName, request.AccountID, request.Region,
+		revisionInfo.owner+"/"+revisionInfo.repo)
+
+	if target.forAction(detail.Stage, action).allows(routingRules, routeStatus) {
+		err = updateGitHubStatus(ctx, &commitStatus)
+
+		if err != nil {
+			log.Printf("error updating GitHub commit status: %s", err.Error())
+		}
+	}
+
+	if config.PipelineOverview && listErr == nil && target.allows(routingRules, routeDeployment) {
+		updatePipelineOverview(ctx, gh, details, revisionInfo, request.Region, executions)
 	}
 
 	return err
 }
 
-func processCodeBuildNotification(detail map[string]interface{}) error {
-	currentPhase := detail["current-phase"].(string)
-	if currentPhase != "COMPLETED" {
-		log.Printf("ignoring build notification for phase %s", currentPhase)
+func processCodeBuildNotification(ctx context.Context, request events.CloudWatchEvent) error {
+	var detail codeBuildStateDetail
+
+	err := decodeDetail(request, &detail)
+	if err != nil {
+		return err
+	}
+
+	if detail.CurrentPhase != "COMPLETED" {
+		log.Printf("ignoring build notification for phase %s", detail.CurrentPhase)
 		return nil
 	}
 
 	// the CodeBuild event notifications have inconsistent information
 	// data fields only contain PR ID when configured for PR_* events, not PUSH
-	buildID := detail["build-id"].(string)
-	projectName := detail["project-name"].(string)
-	details, err := getCodeBuildDetails(buildID, maxLogLines, projectName)
+	spanFromContext(ctx).set("codebuild.project", detail.ProjectName)
+	spanFromContext(ctx).set("codebuild.build_id", detail.BuildID)
 
-	if err == nil {
-		err = upsertGitHubLogComment(&details, gitHubToken)
+	details, err := getCodeBuildDetails(ctx, detail.BuildID, maxLogLines, detail.ProjectName)
+	if err != nil {
+		return err
 	}
 
-	return err
-}
+	traceRevision(ctx, details.host, details.owner, details.repo, details.commitID)
+
+	gh, err := getGitHubClient(details.host, details.owner)
+	if err != nil {
+		return err
+	}
 
-// HandleRequest is the main entry point for the lambda processing.
-func HandleRequest(ctx context.Context, request events.CloudWatchEvent) error {
-	// unmarshal detail
-	// https://docs.aws.amazon.com/AmazonCloudWatch/latest/events/EventTypes.html#codepipeline_event_type
-	var holder interface{}
+	ctx = withAuditCommit(ctx, details.owner, details.repo, details.commitID)
+	config := loadRepoConfig(ctx, gh, details.owner, details.repo, details.commitID)
 
-	err := json.Unmarshal(request.Detail, &holder)
+	if !config.Comments {
+		log.Printf("Comments are disabled by %s in %s/%s", repoConfigPath, details.owner, details.repo)
+		return nil
+	}
+
+	target := buildTarget(ctx, gh, &details, request.AccountID, request.Region)
+	if !target.allows(routingRules, routeComment) {
+		log.Printf("Comments on %s are turned off by the routing rules", details.projectName)
+		return nil
+	}
+
+	if details.summary.status == codebuild.StatusTypeSucceeded &&
+		config.commentPolicy(details.projectName) != commentAlways {
+		return resolveLogComments(ctx, gh, &details, &config)
+	}
 
+	recent, next, err := listRecentBuilds(ctx, details.projectName, details.buildID, nil)
 	if err != nil {
-		return fmt.Errorf("unable to unmarshal Lambda Event detail: %s", err)
+		log.Printf("Unable to compare with recent builds: %s", err)
 	}
 
-	detail := holder.(map[string]interface{})
+	addBuildTrend(ctx, gh, &details, &config, recent)
+	addPullRequestCost(ctx, gh, &details, recent, next)
 
-	switch request.DetailType {
-	case "CodePipeline Action Execution State Change":
-		err = processCodePipelineNotification(request, detail)
-	case "CodeBuild Build State Change": // these come from PR builds
-		err = processCodeBuildNotification(detail)
-	default:
+	if len(config.JUnitReports) > 0 {
+		details.junit = loadJUnitReports(ctx, getAWSClients().s3, details.outputs, config.JUnitReports)
+	}
+
+	err = formatLogComment(&details, &config)
+	if err == nil {
+		err = upsertGitHubLogComment(ctx, gh, &details, &config)
+	}
+
+	return err
+}
+
+// dispatch a single EventBridge event once any envelope has been removed
+func handleCloudWatchEvent(ctx context.Context, request events.CloudWatchEvent) error {
+	handler, ok := eventHandlers[request.DetailType]
+	if !ok {
 		log.Printf("Ignoring %s\n", request.DetailType)
+		return nil
 	}
 
+	done := trackWork(ctx, request.DetailType+" event "+request.ID)
+	defer done()
+
+	ctx, span := startSpan(withAuditEvent(ctx, request.ID), request.DetailType, spanKindInternal)
+	span.set("event.id", request.ID)
+	span.set("event.source", request.Source)
+	span.set("cloud.account.id", request.AccountID)
+	span.set("cloud.region", request.Region)
+
+	err := handler(ctx, request)
+	span.finish(err)
+
 	return err
 }
 
 func main() {
 	// initialize secrets on lambda boot, not on every invocation
 	var err error
-	gitHubToken, err = getGitHubToken()
+	tracer = getTracer()
+	gitHubCredentialSet, err = getGitHubCredentials()
 	maxLogLines = getMaxLogLines()
+	maxPhaseLogLines = getMaxPhaseLogLines()
+	prices = getPriceTable()
+	artifactProjects = getArtifactProjects()
+	artifactLinkExpiry = getArtifactLinkExpiry()
+	stuckScanPipelines = getStuckScanPipelines()
+	notificationSinks = getNotificationSinks()
+
+	if err != nil {
+		log.Printf("Error loading github credentials: %s", err.Error())
+		os.Exit(1)
+	}
 
+	auditLog, err = getAuditLog()
 	if err != nil {
-		log.Printf("Error loading github access token: %s", err.Error())
+		log.Printf("Error configuring the audit log: %s", err)
 		os.Exit(1)
 	}
 
-	lambda.Start(HandleRequest)
+	routingRules, err = getRoutingRules()
+	if err != nil {
+		log.Printf("Error loading routing rules: %s", err)
+		os.Exit(1)
+	}
+
+	mode, args := runtimeMode(os.Args[1:])
+
+	switch mode {
+	case "lambda":
+		lambda.Start(HandleRequest)
+	case "serve":
+		err = runServer(args)
+	case "reconcile":
+		err = runReconcile(args)
+	case "audit":
+		err = runAudit(args)
+	default:
+		err = fmt.Errorf("unknown mode %s", mode)
+	}
+
+	if err != nil {
+		log.Printf("Error running %s: %s", mode, err)
+		os.Exit(1)
+	}
+}
+
+// the first argument picks the runtime, PIPELINE_MONITOR_MODE does the same
+// for containers that can't change their command. Without either we are a
+// lambda.
+func runtimeMode(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+
+	if mode := os.Getenv("PIPELINE_MONITOR_MODE"); mode != "" {
+		return mode, args
+	}
+
+	return "lambda", args
 }
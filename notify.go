@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// a notificationSink tells people about things a commit status can't, like
+// a deploy that has been hanging for hours
+type notificationSink interface {
+	notify(ctx context.Context, message string) error
+}
+
+// webhookSink posts the message as JSON to an incoming webhook, in the one
+// field the webhook reads
+type webhookSink struct {
+	url    string
+	field  string
+	client *http.Client
+}
+
+// Chime incoming webhooks read {"Content": message}, Slack and most others
+// {"text": message}
+func webhookPayloadField(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err == nil && strings.HasSuffix(u.Hostname(), "hooks.chime.aws") {
+		return "Content"
+	}
+
+	return "text"
+}
+
+func (s webhookSink) notify(ctx context.Context, message string) error {
+	body, err := json.Marshal(map[string]string{s.field: message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("unable to send notification: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// NOTIFICATION_WEBHOOK_URLS is a comma separated list of incoming webhooks,
+// notifications are off without it
+func getNotificationSinks() []notificationSink {
+	var sinks []notificationSink
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for _, u := range strings.Split(os.Getenv("NOTIFICATION_WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			sinks = append(sinks, webhookSink{url: u, field: webhookPayloadField(u), client: client})
+		}
+	}
+
+	return sinks
+}
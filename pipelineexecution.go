@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+)
+
+// post a status for every action that has not run in this execution, so a PR
+// can't look green before the later stages have even started
+func plannedStatuses(pipeline *codepipeline.PipelineDeclaration,
+	executions map[string]*codepipeline.ActionExecutionDetail, executionState string,
+	template statusInfo, config *repoConfig) []statusInfo {
+	var statuses []statusInfo
+
+	for _, stage := range pipeline.Stages {
+		for _, action := range stage.Actions {
+			// source actions are the GitHub trigger itself
+			if action.ActionTypeId != nil &&
+				aws.StringValue(action.ActionTypeId.Category) == codepipeline.ActionCategorySource {
+				continue
+			}
+
+			if _, ok := executions[actionKey(aws.StringValue(stage.Name), aws.StringValue(action.Name))]; ok {
+				// the action events own this status from here on
+				continue
+			}
+
+			status := template
+			status.label = statusLabelFor(aws.StringValue(action.Name), config)
+			status.stage = aws.StringValue(stage.Name)
+			status.action = aws.StringValue(action.Name)
+
+			// actions that never ran did not fail, the commit stays red or green
+			// by the actions that did
+			status.state = "pending"
+			if executionState == "STARTED" {
+				status.description = fmt.Sprintf("Queued, %s stage has not started", aws.StringValue(stage.Name))
+			} else {
+				status.description = fmt.Sprintf("Not run, pipeline execution %s", strings.ToLower(executionState))
+			}
+
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// the source action of a starting execution usually records the revision
+// within seconds
+const (
+	revisionPollInterval = 2 * time.Second
+	revisionPollAttempts = 10
+)
+
+// waitForRevision calls lookup until the execution has a revision, the
+// attempts or the time left run out
+func waitForRevision(ctx context.Context, lookup func() (*revisionInfo, error), interval time.Duration,
+	attempts int) (*revisionInfo, error) {
+	for attempt := 1; ; attempt++ {
+		info, err := lookup()
+		if err != errNoRevisionYet || attempt == attempts || nearDeadline(ctx) {
+			return info, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func processPipelineExecutionNotification(ctx context.Context, request events.CloudWatchEvent) error {
+	var detail codePipelineExecutionDetail
+
+	err := decodeDetail(request, &detail)
+	if err != nil {
+		return err
+	}
+
+	// https://docs.aws.amazon.com/codepipeline/latest/userguide/detect-state-changes-cloudwatch-events.html
+	switch detail.State {
+	case "STARTED", "FAILED", "STOPPED", "SUPERSEDED":
+	default:
+		log.Printf("Ignoring pipeline execution state %s", detail.State)
+		return nil
+	}
+
+	details := executionDetails{
+		pipelineName: detail.Pipeline,
+		executionID:  detail.ExecutionID,
+	}
+	tracePipeline(ctx, details)
+
+	pipelineStatusPage := executionTimelineURL(request.Region, details)
+
+	revisionInfo, err := waitForRevision(ctx, func() (*revisionInfo, error) {
+		return getRevisionID(ctx, details)
+	}, revisionPollInterval, revisionPollAttempts)
+	if err != nil {
+		log.Printf("Error getting revision ID for %s: %s", pipelineStatusPage, err.Error())
+		return nil
+	}
+
+	traceRevision(ctx, revisionInfo.host, revisionInfo.owner, revisionInfo.repo, revisionInfo.commit)
+
+	gh, err := getGitHubClient(revisionInfo.host, revisionInfo.owner)
+	if err != nil {
+		return err
+	}
+
+	config := loadRepoConfig(ctx, gh, revisionInfo.owner, revisionInfo.repo, revisionInfo.commit)
+
+	if !config.Statuses {
+		return nil
+	}
+
+	pipeline, err := getPipelineDeclaration(ctx, details.pipelineName)
+	if err != nil {
+		return err
+	}
+
+	// fast actions may already have reported before this event arrived
+	executions, err := listActionExecutions(ctx, details)
+	if err != nil {
+		return err
+	}
+
+	template := statusInfo{
+		host:     revisionInfo.host,
+		commitID: revisionInfo.commit,
+		owner:    revisionInfo.owner,
+		repo:     revisionInfo.repo,
+		url:      pipelineStatusPage,
+	}
+
+	target := pipelineTarget(ctx, details.pipelineName, request.AccountID, request.Region,
+		revisionInfo.owner+"/"+revisionInfo.repo)
+	statuses := routeStatuses(plannedStatuses(pipeline, executions, detail.State, template, &config),
+		&target, routingRules)
+
+	for _, status := range statuses {
+		status := status
+
+		err = updateGitHubStatus(ctx, &status)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
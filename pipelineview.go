@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/google/go-github/github"
+)
+
+type actionView struct {
+	name     string
+	runOrder int64
+	status   string
+	duration time.Duration
+}
+
+type stageView struct {
+	name    string
+	actions []actionView
+}
+
+type pipelineOverview struct {
+	pipelineName string
+	executionID  string
+	stages       []stageView
+}
+
+func getPipelineDeclaration(ctx context.Context, pipelineName string) (*codepipeline.PipelineDeclaration, error) {
+	svc := getAWSClients().codePipeline
+
+	result, err := svc.GetPipelineWithContext(ctx, &codepipeline.GetPipelineInput{
+		Name: aws.String(pipelineName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve pipeline %s: %s", pipelineName, err)
+	}
+
+	return result.Pipeline, nil
+}
+
+func actionKey(stage, action string) string {
+	return stage + "/" + action
+}
+
+// the latest execution of every action in a single pipeline run, keyed by
+// stage and action name
+func listActionExecutions(ctx context.Context,
+	details executionDetails) (map[string]*codepipeline.ActionExecutionDetail, error) {
+	svc := getAWSClients().codePipeline
+
+	executions := make(map[string]*codepipeline.ActionExecutionDetail)
+	input := &codepipeline.ListActionExecutionsInput{
+		PipelineName: aws.String(details.pipelineName),
+		Filter: &codepipeline.ActionExecutionFilter{
+			PipelineExecutionId: aws.String(details.executionID),
+		},
+	}
+
+	err := svc.ListActionExecutionsPagesWithContext(ctx, input, func(page *codepipeline.ListActionExecutionsOutput,
+		lastPage bool) bool {
+		for _, e := range page.ActionExecutionDetails {
+			key := actionKey(aws.StringValue(e.StageName), aws.StringValue(e.ActionName))
+			// retried stages run an action more than once, the newest run wins
+			if previous, ok := executions[key]; !ok ||
+				aws.TimeValue(e.StartTime).After(aws.TimeValue(previous.StartTime)) {
+				executions[key] = e
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list action executions for %s: %s", details.executionID, err)
+	}
+
+	return executions, nil
+}
+
+// combine the pipeline structure with the action executions of a single run,
+// actions that have not started yet have no execution and no status
+func getPipelineOverview(ctx context.Context, details executionDetails,
+	executions map[string]*codepipeline.ActionExecutionDetail) (pipelineOverview, error) {
+	overview := pipelineOverview{
+		pipelineName: details.pipelineName,
+		executionID:  details.executionID,
+	}
+
+	pipeline, err := getPipelineDeclaration(ctx, details.pipelineName)
+	if err != nil {
+		return overview, err
+	}
+
+	for _, stage := range pipeline.Stages {
+		view := stageView{name: aws.StringValue(stage.Name)}
+
+		for _, action := range stage.Actions {
+			a := actionView{
+				name:     aws.StringValue(action.Name),
+				runOrder: aws.Int64Value(action.RunOrder),
+			}
+
+			if e, ok := executions[actionKey(view.name, a.name)]; ok {
+				a.status = aws.StringValue(e.Status)
+				a.duration = actionDuration(e, time.Now())
+			}
+
+			view.actions = append(view.actions, a)
+		}
+
+		overview.stages = append(overview.stages, view)
+	}
+
+	return overview, nil
+}
+
+func actionDuration(e *codepipeline.ActionExecutionDetail, now time.Time) time.Duration {
+	if e.StartTime == nil {
+		return 0
+	}
+
+	end := now
+	if aws.StringValue(e.Status) != codepipeline.ActionExecutionStatusInProgress && e.LastUpdateTime != nil {
+		end = *e.LastUpdateTime
+	}
+
+	return end.Sub(*e.StartTime).Round(time.Second)
+}
+
+var mermaidClasses = map[string]string{
+	codepipeline.ActionExecutionStatusInProgress: "inprogress",
+	codepipeline.ActionExecutionStatusSucceeded:  "succeeded",
+	codepipeline.ActionExecutionStatusFailed:     "failed",
+	// not an enum value in this version of the SDK
+	"Abandoned": "abandoned",
+}
+
+// mermaid labels are quoted, so quotes in action names have to go
+func mermaidLabel(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s)
+}
+
+// render the overview as a mermaid flowchart, GitHub draws these inline
+// https://mermaid-js.github.io/mermaid/#/flowchart
+func renderMermaid(overview pipelineOverview) string {
+	var chart strings.Builder
+
+	chart.WriteString("flowchart LR\n")
+
+	var classes []string
+
+	for i, stage := range overview.stages {
+		fmt.Fprintf(&chart, "  subgraph s%d[\"%s\"]\n", i, mermaidLabel(stage.name))
+
+		// actions with the same runOrder run in parallel, each group waits for
+		// the previous one
+		groups := make(map[int64][]string)
+
+		var orders []int64
+
+		for j, action := range stage.actions {
+			id := fmt.Sprintf("s%da%d", i, j)
+			status := "Not started"
+
+			if action.status != "" {
+				status = fmt.Sprintf("%s %s", action.status, action.duration)
+				classes = append(classes, fmt.Sprintf("  class %s %s\n", id, mermaidClasses[action.status]))
+			}
+
+			fmt.Fprintf(&chart, "    %s[\"%s<br/>%s\"]\n", id, mermaidLabel(action.name), status)
+
+			if _, ok := groups[action.runOrder]; !ok {
+				orders = append(orders, action.runOrder)
+			}
+
+			groups[action.runOrder] = append(groups[action.runOrder], id)
+		}
+
+		sort.Slice(orders, func(a, b int) bool { return orders[a] < orders[b] })
+
+		for k := 1; k < len(orders); k++ {
+			for _, from := range groups[orders[k-1]] {
+				for _, to := range groups[orders[k]] {
+					fmt.Fprintf(&chart, "    %s --> %s\n", from, to)
+				}
+			}
+		}
+
+		chart.WriteString("  end\n")
+
+		if i > 0 {
+			fmt.Fprintf(&chart, "  s%d --> s%d\n", i-1, i)
+		}
+	}
+
+	chart.WriteString("  classDef succeeded fill:#2da44e,color:#fff\n")
+	chart.WriteString("  classDef failed fill:#cf222e,color:#fff\n")
+	chart.WriteString("  classDef inprogress fill:#bf8700,color:#fff\n")
+	chart.WriteString("  classDef abandoned fill:#6e7781,color:#fff\n")
+
+	for _, c := range classes {
+		chart.WriteString(c)
+	}
+
+	return chart.String()
+}
+
+func formatPipelineOverview(overview pipelineOverview, region, commentTag string) string {
+	return fmt.Sprintf(`<!-- %s -->
+## Pipeline overview for %s
+
+Execution [%s](https://%s.console.aws.amazon.com/codesuite/codepipeline/pipelines/%s/executions/%s/timeline)
+
+%smermaid
+%s%s
+`,
+		commentTag, overview.pipelineName, overview.executionID,
+		region, overview.pipelineName, overview.executionID,
+		"```", renderMermaid(overview), "```")
+}
+
+// the commits/{sha}/pulls endpoint is not in this version of go-github
+func listPullRequestsWithCommit(ctx context.Context, gh *github.Client,
+	owner, repo, sha string) ([]*github.PullRequest, error) {
+	u := fmt.Sprintf("repos/%s/%s/commits/%s/pulls", owner, repo, sha)
+
+	req, err := gh.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/vnd.github.groot-preview+json")
+
+	var pulls []*github.PullRequest
+
+	_, err = gh.Do(ctx, req, &pulls)
+
+	return pulls, err
+}
+
+// keep a single overview comment per pipeline up to date, on the PR when
+// the commit belongs to an open one and on the commit otherwise
+func upsertPipelineOverview(ctx context.Context, gh *github.Client, revision *revisionInfo,
+	body, commentTag string) error {
+	ctx = withAuditCommit(ctx, revision.owner, revision.repo, revision.commit)
+
+	pulls, err := listPullRequestsWithCommit(ctx, gh, revision.owner, revision.repo, revision.commit)
+	if err != nil {
+		return fmt.Errorf("unable to list pull requests for %s: %s", revision.commit, err)
+	}
+
+	for _, pr := range pulls {
+		if pr.GetState() == "open" {
+			return upsertPullRequestOverview(ctx, gh, revision, pr.GetNumber(), body, commentTag)
+		}
+	}
+
+	existing, err := findCommitComment(ctx, gh, revision, commentTag)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		_, _, err = gh.Repositories.UpdateComment(ctx, revision.owner, revision.repo, existing.GetID(),
+			&github.RepositoryComment{Body: &body})
+		return err
+	}
+
+	_, _, err = gh.Repositories.CreateComment(ctx, revision.owner, revision.repo, revision.commit,
+		&github.RepositoryComment{Body: &body})
+
+	return err
+}
+
+// the commit comment carrying commentTag, nil when there is none
+func findCommitComment(ctx context.Context, gh *github.Client, revision *revisionInfo,
+	commentTag string) (*github.RepositoryComment, error) {
+	opt := &github.ListOptions{PerPage: 100}
+
+	for {
+		comments, resp, err := gh.Repositories.ListCommitComments(ctx, revision.owner, revision.repo,
+			revision.commit, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, comment := range comments {
+			if strings.Contains(comment.GetBody(), commentTag) {
+				return comment, nil
+			}
+		}
+
+		if resp.NextPage == 0 {
+			return nil, nil
+		}
+
+		opt.Page = resp.NextPage
+	}
+}
+
+func upsertPullRequestOverview(ctx context.Context, gh *github.Client, revision *revisionInfo, prID int,
+	body, commentTag string) error {
+	existing, err := listTaggedComments(ctx, gh, revision.owner, revision.repo, prID, commentTag)
+	if err != nil {
+		return err
+	}
+
+	comment := &github.IssueComment{Body: &body}
+
+	if len(existing) > 0 {
+		_, _, err = gh.Issues.EditComment(ctx, revision.owner, revision.repo, existing[0].ID, comment)
+		return err
+	}
+
+	_, _, err = gh.Issues.CreateComment(ctx, revision.owner, revision.repo, prID, comment)
+
+	return err
+}
+
+// the overview is an extra, failures are logged so the status update still
+// counts as processed
+func updatePipelineOverview(ctx context.Context, gh *github.Client, details executionDetails,
+	revision *revisionInfo, region string, executions map[string]*codepipeline.ActionExecutionDetail) {
+	overview, err := getPipelineOverview(ctx, details, executions)
+	if err != nil {
+		log.Printf("Unable to build pipeline overview: %s", err)
+		return
+	}
+
+	commentTag := "PIPELINE_MONITOR_GENERATED_OVERVIEW_" + strings.ToUpper(details.pipelineName)
+	body := formatPipelineOverview(overview, region, commentTag)
+
+	err = upsertPipelineOverview(ctx, gh, revision, body, commentTag)
+	if err != nil {
+		log.Printf("Unable to post pipeline overview for %s: %s", details.executionID, err)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/google/go-github/github"
+)
+
+type reconcileOptions struct {
+	pipelines []string
+	since     time.Time
+	until     time.Time
+	dryRun    bool
+	// the account of the pipelines, for routing rules that match on it or on
+	// pipeline tags
+	account string
+	// owner/repo and commit, when only the executions of one commit count
+	repo   string
+	commit string
+}
+
+func parseReconcileOptions(args []string, now time.Time) (reconcileOptions, error) {
+	var opts reconcileOptions
+
+	var pipelines string
+
+	var since, until time.Duration
+
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	flags.StringVar(&pipelines, "pipelines", "", "comma separated list of pipelines to reconcile")
+	flags.DurationVar(&since, "since", 24*time.Hour, "reconcile executions started up to this long ago")
+	flags.DurationVar(&until, "until", 0, "skip executions started more recently than this")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "report the differences without posting corrections")
+	flags.StringVar(&opts.account, "account", "", "AWS account of the pipelines, defaults to the caller's account")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return opts, err
+	}
+
+	for _, name := range strings.Split(pipelines, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			opts.pipelines = append(opts.pipelines, name)
+		}
+	}
+
+	if len(opts.pipelines) == 0 {
+		return opts, fmt.Errorf("at least one pipeline is required")
+	}
+
+	if until >= since {
+		return opts, fmt.Errorf("-until must be more recent than -since")
+	}
+
+	opts.since = now.Add(-since)
+	opts.until = now.Add(-until)
+
+	return opts, nil
+}
+
+// action states as they appear in action execution events, so that
+// reconciled statuses match the ones the events would have posted
+var actionEventStates = map[string]string{
+	codepipeline.ActionExecutionStatusInProgress: "STARTED",
+	codepipeline.ActionExecutionStatusSucceeded:  "SUCCEEDED",
+	codepipeline.ActionExecutionStatusFailed:     "FAILED",
+	"Abandoned":                                  "CANCELED",
+}
+
+// pipeline states as they appear in pipeline execution events, only the
+// final states are reconciled since running executions still send events
+var pipelineEventStates = map[string]string{
+	codepipeline.PipelineExecutionStatusSucceeded:  "SUCCEEDED",
+	codepipeline.PipelineExecutionStatusFailed:     "FAILED",
+	codepipeline.PipelineExecutionStatusSuperseded: "SUPERSEDED",
+	// not an enum value in this version of the SDK
+	"Stopped": "STOPPED",
+}
+
+// the statuses a commit should show once an execution has finished, the same
+// ones the action and pipeline execution events post
+func expectedStatuses(pipeline *codepipeline.PipelineDeclaration,
+	executions map[string]*codepipeline.ActionExecutionDetail, executionState, region string,
+	template statusInfo, config *repoConfig) []statusInfo {
+	var statuses []statusInfo
+
+	for _, stage := range pipeline.Stages {
+		stageName := aws.StringValue(stage.Name)
+
+		for _, action := range stage.Actions {
+			if action.ActionTypeId != nil &&
+				aws.StringValue(action.ActionTypeId.Category) == codepipeline.ActionCategorySource {
+				continue
+			}
+
+			execution, ok := executions[actionKey(stageName, aws.StringValue(action.Name))]
+			if !ok {
+				continue
+			}
+
+			status := actionStatus(template, stageName, aws.StringValue(action.Name),
+				actionEventStates[aws.StringValue(execution.Status)], region, config)
+			applyActionExecution(&status, execution)
+			statuses = append(statuses, status)
+		}
+	}
+
+	if executionState != "SUCCEEDED" {
+		statuses = append(statuses, plannedStatuses(pipeline, executions, executionState, template, config)...)
+	}
+
+	return statuses
+}
+
+type statusCorrection struct {
+	status  statusInfo
+	current string
+}
+
+// only the state is compared, descriptions and links from older versions of
+// the monitor are not worth a new status
+func statusCorrections(expected []statusInfo, current []github.RepoStatus) []statusCorrection {
+	states := make(map[string]string)
+	for _, status := range current {
+		states[status.GetContext()] = status.GetState()
+	}
+
+	var corrections []statusCorrection
+
+	for _, status := range expected {
+		if state := states[status.label]; state != status.state {
+			corrections = append(corrections, statusCorrection{status: status, current: state})
+		}
+	}
+
+	return corrections
+}
+
+func formatCorrection(c statusCorrection) string {
+	current := c.current
+	if current == "" {
+		current = "missing"
+	}
+
+	return fmt.Sprintf("%s/%s@%.7s %q: %s -> %s (%s)", c.status.owner, c.status.repo, c.status.commitID,
+		c.status.label, current, c.status.state, c.status.description)
+}
+
+// the latest status for every context on a commit
+func getCommitStatuses(ctx context.Context, gh *github.Client, owner, repo, ref string) ([]github.RepoStatus, error) {
+	var statuses []github.RepoStatus
+
+	opt := &github.ListOptions{PerPage: 100}
+
+	for {
+		combined, resp, err := gh.Repositories.GetCombinedStatus(ctx, owner, repo, ref, opt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get status of %s/%s@%s: %s", owner, repo, ref, err)
+		}
+
+		statuses = append(statuses, combined.Statuses...)
+
+		if resp.NextPage == 0 {
+			return statuses, nil
+		}
+
+		opt.Page = resp.NextPage
+	}
+}
+
+// executions of a pipeline started in the window, newest first
+func listExecutionsInWindow(ctx context.Context, pipelineName string, since,
+	until time.Time) ([]*codepipeline.PipelineExecutionSummary, error) {
+	svc := getAWSClients().codePipeline
+
+	var summaries []*codepipeline.PipelineExecutionSummary
+
+	input := &codepipeline.ListPipelineExecutionsInput{PipelineName: aws.String(pipelineName)}
+
+	err := svc.ListPipelineExecutionsPagesWithContext(ctx, input, func(page *codepipeline.ListPipelineExecutionsOutput,
+		lastPage bool) bool {
+		for _, summary := range page.PipelineExecutionSummaries {
+			started := aws.TimeValue(summary.StartTime)
+			if started.Before(since) {
+				// executions are listed newest first
+				return false
+			}
+
+			if !started.After(until) {
+				summaries = append(summaries, summary)
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list executions of %s: %s", pipelineName, err)
+	}
+
+	return summaries, nil
+}
+
+// events carry the account of the pipeline, reconcile runs with credentials
+// of the same account unless told otherwise
+func getCallerAccount(ctx context.Context) (string, error) {
+	identity, err := getAWSClients().sts.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("unable to find the AWS account, set -account: %s", err)
+	}
+
+	return aws.StringValue(identity.Account), nil
+}
+
+func (o *reconcileOptions) includes(revision *revisionInfo) bool {
+	return o.commit == "" || (revision.commit == o.commit && strings.EqualFold(revision.owner+"/"+revision.repo, o.repo))
+}
+
+func reconcilePipeline(ctx context.Context, pipelineName, region string,
+	opts reconcileOptions) (int, error) {
+	summaries, err := listExecutionsInWindow(ctx, pipelineName, opts.since, opts.until)
+	if err != nil {
+		return 0, err
+	}
+
+	pipeline, err := getPipelineDeclaration(ctx, pipelineName)
+	if err != nil {
+		return 0, err
+	}
+
+	corrected := 0
+	// a commit built more than once shows the statuses of its newest execution
+	seen := make(map[string]bool)
+
+	for _, summary := range summaries {
+		details := executionDetails{
+			pipelineName: pipelineName,
+			executionID:  aws.StringValue(summary.PipelineExecutionId),
+		}
+
+		revision, err := getRevisionID(ctx, details)
+		if err != nil {
+			log.Printf("Skipping %s: %s", details.executionID, err)
+			continue
+		}
+
+		if !opts.includes(revision) || seen[revision.commit] {
+			continue
+		}
+
+		seen[revision.commit] = true
+
+		// running executions still send events of their own
+		executionState, finished := pipelineEventStates[aws.StringValue(summary.Status)]
+		if !finished {
+			continue
+		}
+
+		gh, err := getGitHubClient(revision.host, revision.owner)
+		if err != nil {
+			log.Printf("Skipping %s: %s", details.executionID, err)
+			continue
+		}
+
+		config := loadRepoConfig(ctx, gh, revision.owner, revision.repo, revision.commit)
+		if !config.Statuses {
+			continue
+		}
+
+		executions, err := listActionExecutions(ctx, details)
+		if err != nil {
+			return corrected, err
+		}
+
+		template := statusInfo{
+			host:     revision.host,
+			commitID: revision.commit,
+			owner:    revision.owner,
+			repo:     revision.repo,
+			url:      executionTimelineURL(region, details),
+		}
+		target := pipelineTarget(ctx, pipelineName, opts.account, region, revision.owner+"/"+revision.repo)
+		expected := routeStatuses(expectedStatuses(pipeline, executions, executionState, region, template, &config),
+			&target, routingRules)
+
+		current, err := getCommitStatuses(ctx, gh, revision.owner, revision.repo, revision.commit)
+		if err != nil {
+			return corrected, err
+		}
+
+		for _, correction := range statusCorrections(expected, current) {
+			correction := correction
+
+			fmt.Println(formatCorrection(correction))
+
+			if !opts.dryRun {
+				err = updateGitHubStatus(ctx, &correction.status)
+				if err != nil {
+					return corrected, err
+				}
+			}
+
+			corrected++
+		}
+	}
+
+	return corrected, nil
+}
+
+// runReconcile corrects commit statuses that missed their events, e.g. while
+// the lambda was failing
+func runReconcile(args []string) error {
+	opts, err := parseReconcileOptions(args, time.Now())
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// statuses are mutations like any other, the batch is written at the end
+	defer auditLog.flush(ctx)
+	defer tracer.flush()
+
+	region := aws.StringValue(getAWSClients().codePipeline.Config.Region)
+
+	if opts.account == "" {
+		opts.account, err = getCallerAccount(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	total := 0
+
+	for _, pipelineName := range opts.pipelines {
+		pipelineCtx, span := startSpan(ctx, "reconcile "+pipelineName, spanKindInternal)
+		span.set("codepipeline.pipeline", pipelineName)
+
+		corrected, err := reconcilePipeline(pipelineCtx, pipelineName, region, opts)
+		span.finish(err)
+
+		total += corrected
+
+		if err != nil {
+			return fmt.Errorf("reconciling %s: %s", pipelineName, err)
+		}
+	}
+
+	if opts.dryRun {
+		log.Printf("Found %d statuses to correct", total)
+	} else {
+		log.Printf("Corrected %d statuses", total)
+	}
+
+	return nil
+}
+
+// how far back a rerequested check run looks for executions of its commit
+const rerequestWindow = 24 * time.Hour
+
+// the reconcile options for a check_run webhook, false for actions other
+// than rerequested
+func parseCheckRunWebhook(request events.CloudWatchEvent, now time.Time) (reconcileOptions, bool, error) {
+	opts := reconcileOptions{since: now.Add(-rerequestWindow), until: now}
+
+	var event github.CheckRunEvent
+
+	err := json.Unmarshal(request.Detail, &event)
+	if err != nil {
+		return opts, false, malformedEvent("unable to unmarshal check_run webhook %s: %s", request.ID, err)
+	}
+
+	if event.GetAction() != "rerequested" {
+		return opts, false, nil
+	}
+
+	opts.repo = event.GetRepo().GetFullName()
+	opts.commit = event.GetCheckRun().GetHeadSHA()
+
+	if opts.repo == "" || opts.commit == "" {
+		return opts, false, malformedEvent("check_run webhook %s has no repository or head_sha", request.ID)
+	}
+
+	return opts, true, nil
+}
+
+// processCheckRunWebhook corrects the statuses of a commit when someone asks
+// GitHub to run its checks again, the same way reconcile does for a window
+func processCheckRunWebhook(ctx context.Context, request events.CloudWatchEvent) error {
+	opts, ok, err := parseCheckRunWebhook(request, time.Now())
+	if err != nil || !ok {
+		return err
+	}
+
+	pipelines := stuckScanPipelines
+	if len(pipelines) == 0 {
+		pipelines, err = listPipelineNames(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// webhooks come from GitHub, the pipelines are in our own account
+	opts.account, err = getCallerAccount(ctx)
+	if err != nil {
+		return err
+	}
+
+	region := aws.StringValue(getAWSClients().codePipeline.Config.Region)
+
+	var firstErr error
+
+	for _, pipelineName := range pipelines {
+		pipelineCtx, span := startSpan(ctx, "reconcile "+pipelineName, spanKindInternal)
+		span.set("codepipeline.pipeline", pipelineName)
+
+		corrected, err := reconcilePipeline(pipelineCtx, pipelineName, region, opts)
+		span.finish(err)
+
+		if err != nil {
+			log.Printf("Error reconciling %s for %s@%.7s: %s", pipelineName, opts.repo, opts.commit, err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		if corrected > 0 {
+			log.Printf("Corrected %d statuses of %s@%.7s in %s", corrected, opts.repo, opts.commit, pipelineName)
+		}
+	}
+
+	return firstErr
+}
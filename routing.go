@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/google/go-github/github"
+)
+
+// what an event may do, routing rules allow or deny each of them
+const (
+	routeStatus       = "status"       // commit statuses for pipeline actions
+	routeComment      = "comment"      // build log comments on PRs
+	routeDeployment   = "deployment"   // the pipeline overview of a deploy
+	routeNotification = "notification" // notification sinks, e.g. stuck actions
+)
+
+// routingRule matches events by glob patterns, empty fields match anything.
+// Tags are pipeline tags from ListTagsForResource, every tag has to match.
+//
+//	[
+//	  {"effect": "deny", "actions": ["comment"], "project": "nightly-*"},
+//	  {"effect": "allow", "tags": {"pipeline-monitor": "enabled"}},
+//	  {"effect": "deny", "actions": ["status", "deployment"]}
+//	]
+type routingRule struct {
+	Effect  string   `json:"effect"`
+	Actions []string `json:"actions"`
+
+	Project  string            `json:"project"`
+	Pipeline string            `json:"pipeline"`
+	Stage    string            `json:"stage"`
+	Action   string            `json:"action"`
+	Account  string            `json:"account"`
+	Region   string            `json:"region"`
+	Repo     string            `json:"repo"` // owner/repo
+	Branch   string            `json:"branch"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// routeTarget describes what an event is about. Branch and tags cost API
+// calls, so they are only loaded when a rule asks for them.
+type routeTarget struct {
+	project  string
+	pipeline string
+	stage    string
+	action   string
+	account  string
+	region   string
+	repo     string
+	branch   func() string
+	tags     func() map[string]string
+}
+
+// ROUTING_RULES is a JSON list of rules, the first rule that matches an
+// event and action decides. Without a matching rule everything is allowed.
+func getRoutingRules() ([]routingRule, error) {
+	value := os.Getenv("ROUTING_RULES")
+	if value == "" {
+		return nil, nil
+	}
+
+	var rules []routingRule
+
+	err := json.Unmarshal([]byte(value), &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ROUTING_RULES: %s", err)
+	}
+
+	for i, rule := range rules {
+		err = rule.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid ROUTING_RULES rule %d: %s", i, err)
+		}
+	}
+
+	return rules, nil
+}
+
+func (r routingRule) validate() error {
+	if r.Effect != "allow" && r.Effect != "deny" {
+		return fmt.Errorf("effect must be allow or deny, got %q", r.Effect)
+	}
+
+	for _, action := range r.Actions {
+		switch action {
+		case routeStatus, routeComment, routeDeployment, routeNotification:
+		default:
+			return fmt.Errorf("unknown action %q", action)
+		}
+	}
+
+	patterns := []string{r.Project, r.Pipeline, r.Stage, r.Action, r.Account, r.Region, r.Repo, r.Branch}
+	for _, value := range r.Tags {
+		patterns = append(patterns, value)
+	}
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %s", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	ok, _ := path.Match(pattern, value)
+
+	return ok
+}
+
+func (r routingRule) matches(target *routeTarget, action string) bool {
+	return r.matchesAction(action) && r.matchesFields(target) && r.matchesTags(target)
+}
+
+func (r routingRule) matchesAction(action string) bool {
+	if len(r.Actions) == 0 {
+		return true
+	}
+
+	for _, a := range r.Actions {
+		if a == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r routingRule) matchesFields(target *routeTarget) bool {
+	if !matchPattern(r.Project, target.project) || !matchPattern(r.Pipeline, target.pipeline) ||
+		!matchPattern(r.Stage, target.stage) || !matchPattern(r.Action, target.action) ||
+		!matchPattern(r.Account, target.account) || !matchPattern(r.Region, target.region) ||
+		!matchPattern(r.Repo, target.repo) {
+		return false
+	}
+
+	return r.Branch == "" || (target.branch != nil && matchPattern(r.Branch, target.branch()))
+}
+
+func (r routingRule) matchesTags(target *routeTarget) bool {
+	if len(r.Tags) == 0 {
+		return true
+	}
+
+	if target.tags == nil {
+		return false
+	}
+
+	tags := target.tags()
+
+	for key, pattern := range r.Tags {
+		value, ok := tags[key]
+		if !ok || !matchPattern(pattern, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *routeTarget) allows(rules []routingRule, action string) bool {
+	for _, rule := range rules {
+		if rule.matches(t, action) {
+			return rule.Effect == "allow"
+		}
+	}
+
+	return true
+}
+
+// the target for a single action of the pipeline
+func (t routeTarget) forAction(stage, action string) *routeTarget {
+	t.stage = stage
+	t.action = action
+
+	return &t
+}
+
+// drop the statuses the routing rules don't allow
+func routeStatuses(statuses []statusInfo, target *routeTarget, rules []routingRule) []statusInfo {
+	var allowed []statusInfo
+
+	for _, status := range statuses {
+		if target.forAction(status.stage, status.action).allows(rules, routeStatus) {
+			allowed = append(allowed, status)
+		}
+	}
+
+	return allowed
+}
+
+type pipelineAttributes struct {
+	tags    map[string]string
+	branch  string
+	expires time.Time
+}
+
+// tags and source branches rarely change, a few minutes of caching keeps
+// busy pipelines from calling the API for every action event
+var pipelineAttributeCache = struct {
+	sync.Mutex
+	entries map[string]pipelineAttributes
+}{entries: make(map[string]pipelineAttributes)}
+
+const pipelineAttributeTTL = 10 * time.Minute
+
+func cachedPipelineAttributes(key string, load func() (pipelineAttributes, error)) pipelineAttributes {
+	now := time.Now()
+
+	pipelineAttributeCache.Lock()
+	entry, ok := pipelineAttributeCache.entries[key]
+	pipelineAttributeCache.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		return entry
+	}
+
+	entry, err := load()
+	if err != nil {
+		// rules that need the attribute won't match, the rest still apply
+		log.Printf("Unable to load %s for routing: %s", key, err)
+		return entry
+	}
+
+	entry.expires = now.Add(pipelineAttributeTTL)
+
+	pipelineAttributeCache.Lock()
+	if len(pipelineAttributeCache.entries) >= repoConfigCacheSize {
+		pipelineAttributeCache.entries = make(map[string]pipelineAttributes)
+	}
+	pipelineAttributeCache.entries[key] = entry
+	pipelineAttributeCache.Unlock()
+
+	return entry
+}
+
+func pipelineTags(ctx context.Context, pipelineName, account, region string) map[string]string {
+	arn := fmt.Sprintf("arn:aws:codepipeline:%s:%s:%s", region, account, pipelineName)
+
+	return cachedPipelineAttributes("tags of "+arn, func() (pipelineAttributes, error) {
+		tags := make(map[string]string)
+
+		err := getAWSClients().codePipeline.ListTagsForResourcePagesWithContext(ctx,
+			&codepipeline.ListTagsForResourceInput{ResourceArn: aws.String(arn)},
+			func(page *codepipeline.ListTagsForResourceOutput, lastPage bool) bool {
+				for _, tag := range page.Tags {
+					tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+				}
+
+				return true
+			})
+
+		return pipelineAttributes{tags: tags}, err
+	}).tags
+}
+
+// the branch the source action of the pipeline follows, GitHub sources call
+// it Branch and CodeStar connections BranchName
+func pipelineBranch(ctx context.Context, pipelineName string) string {
+	return cachedPipelineAttributes("branch of "+pipelineName, func() (pipelineAttributes, error) {
+		pipeline, err := getPipelineDeclaration(ctx, pipelineName)
+		if err != nil {
+			return pipelineAttributes{}, err
+		}
+
+		for _, stage := range pipeline.Stages {
+			for _, action := range stage.Actions {
+				if action.ActionTypeId == nil ||
+					aws.StringValue(action.ActionTypeId.Category) != codepipeline.ActionCategorySource {
+					continue
+				}
+
+				for _, key := range []string{"Branch", "BranchName"} {
+					if branch := aws.StringValue(action.Configuration[key]); branch != "" {
+						return pipelineAttributes{branch: branch}, nil
+					}
+				}
+			}
+		}
+
+		return pipelineAttributes{}, nil
+	}).branch
+}
+
+func pipelineTarget(ctx context.Context, pipelineName, account, region, repo string) routeTarget {
+	return routeTarget{
+		pipeline: pipelineName,
+		account:  account,
+		region:   region,
+		repo:     repo,
+		branch:   func() string { return pipelineBranch(ctx, pipelineName) },
+		tags:     func() map[string]string { return pipelineTags(ctx, pipelineName, account, region) },
+	}
+}
+
+// PR builds are routed on the branch of the pull request
+func buildTarget(ctx context.Context, gh *github.Client, details *buildDetails, account, region string) routeTarget {
+	var once sync.Once
+
+	var branch string
+
+	return routeTarget{
+		project: details.projectName,
+		account: account,
+		region:  region,
+		repo:    details.owner + "/" + details.repo,
+		branch: func() string {
+			once.Do(func() {
+				pr, _, err := gh.PullRequests.Get(ctx, details.owner, details.repo, details.prID)
+				if err != nil {
+					log.Printf("Unable to load the branch of %s/%s#%d for routing: %s",
+						details.owner, details.repo, details.prID, err)
+					return
+				}
+
+				branch = pr.GetHead().GetRef()
+			})
+
+			return branch
+		},
+	}
+}
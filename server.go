@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// EventBridge caps events at 256KB, GitHub webhooks are larger but anything
+// over this is not an event we know how to handle
+const maxEventBytes = 5 << 20
+
+type serverOptions struct {
+	addr            string
+	workers         int
+	queueSize       int
+	shutdownTimeout time.Duration
+	// EVENTS_API_KEY, sent by the EventBridge API destination connection
+	apiKey string
+	// GITHUB_WEBHOOK_SECRET, used to verify X-Hub-Signature-256
+	webhookSecret string
+}
+
+func parseServerOptions(args []string) (serverOptions, error) {
+	opts := serverOptions{
+		apiKey:        os.Getenv("EVENTS_API_KEY"),
+		webhookSecret: os.Getenv("GITHUB_WEBHOOK_SECRET"),
+	}
+
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.StringVar(&opts.addr, "addr", ":8080", "address to listen on")
+	flags.IntVar(&opts.workers, "workers", 4, "events processed concurrently")
+	flags.IntVar(&opts.queueSize, "queue", 100, "events accepted while all workers are busy")
+	flags.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"time allowed for queued events to finish on shutdown")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return opts, err
+	}
+
+	if opts.workers < 1 || opts.queueSize < 0 {
+		return opts, fmt.Errorf("workers must be at least 1 and queue can't be negative")
+	}
+
+	// anyone who can reach the server could otherwise post statuses
+	if opts.apiKey == "" {
+		return opts, fmt.Errorf("EVENTS_API_KEY must be set")
+	}
+
+	return opts, nil
+}
+
+// eventServer accepts events over HTTP and hands them to a fixed pool of
+// workers running the same handler as the lambda
+type eventServer struct {
+	opts    serverOptions
+	jobs    chan json.RawMessage
+	workers sync.WaitGroup
+	handle  func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+}
+
+func newEventServer(opts serverOptions) *eventServer {
+	return &eventServer{
+		opts:   opts,
+		jobs:   make(chan json.RawMessage, opts.queueSize),
+		handle: HandleRequest,
+	}
+}
+
+func (s *eventServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.health)
+	mux.HandleFunc("/events", s.events)
+	mux.HandleFunc("/github", s.github)
+
+	return mux
+}
+
+func (s *eventServer) start(ctx context.Context) {
+	for i := 0; i < s.opts.workers; i++ {
+		s.workers.Add(1)
+
+		go func() {
+			defer s.workers.Done()
+
+			for payload := range s.jobs {
+				s.process(ctx, payload)
+			}
+		}()
+	}
+}
+
+// a panic is logged and fails only the event that caused it, the lambda
+// runtime does the same for an invocation
+func (s *eventServer) process(ctx context.Context, payload json.RawMessage) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic processing event: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	result, err := s.handle(ctx, payload)
+	if err != nil {
+		log.Printf("Error processing event: %s", err)
+	}
+
+	if batch, ok := result.(batchResponse); ok && len(batch.BatchItemFailures) > 0 {
+		log.Printf("Failed to process %d records of a batch", len(batch.BatchItemFailures))
+	}
+}
+
+// stop waits for the queued events to finish, new events must already be
+// refused by shutting down the HTTP server first
+func (s *eventServer) stop() {
+	close(s.jobs)
+	s.workers.Wait()
+}
+
+// a full queue answers 503 so that EventBridge and GitHub retry later
+func (s *eventServer) enqueue(w http.ResponseWriter, payload json.RawMessage) {
+	select {
+	case s.jobs <- payload:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "too many events in flight", http.StatusServiceUnavailable)
+	}
+}
+
+func (s *eventServer) health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func readEventBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEventBytes))
+	if err != nil {
+		http.Error(w, "unable to read request body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// EventBridge API destinations POST the event itself, or any of the
+// envelopes the lambda understands
+func (s *eventServer) events(w http.ResponseWriter, r *http.Request) {
+	if s.opts.apiKey == "" ||
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Api-Key")), []byte(s.opts.apiKey)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, ok := readEventBody(w, r)
+	if !ok {
+		return
+	}
+
+	if !json.Valid(body) {
+		http.Error(w, "request body is not JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.enqueue(w, body)
+}
+
+func validWebhookSignature(secret string, body []byte, signature string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// GitHub webhooks are wrapped as events with a "GitHub <event>" detail type,
+// so handlers for them register in eventHandlers like any other event
+// https://docs.github.com/en/developers/webhooks-and-events/webhooks/securing-your-webhooks
+func (s *eventServer) github(w http.ResponseWriter, r *http.Request) {
+	body, ok := readEventBody(w, r)
+	if !ok {
+		return
+	}
+
+	if s.opts.webhookSecret == "" ||
+		!validWebhookSignature(s.opts.webhookSecret, body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	eventType := r.Header.Get("X-GitHub-Event")
+	if eventType == "ping" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	payload, err := json.Marshal(events.CloudWatchEvent{
+		ID:         r.Header.Get("X-GitHub-Delivery"),
+		DetailType: "GitHub " + eventType,
+		Source:     "github.com",
+		Time:       time.Now().UTC(),
+		Detail:     body,
+	})
+	if err != nil {
+		http.Error(w, "request body is not JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.enqueue(w, payload)
+}
+
+// runServer serves until SIGINT or SIGTERM, then stops accepting events and
+// lets the workers drain the queue
+func runServer(args []string) error {
+	opts, err := parseServerOptions(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newEventServer(opts)
+	s.start(ctx)
+
+	server := &http.Server{
+		Addr:              opts.addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		log.Printf("Listening on %s with %d workers", opts.addr, opts.workers)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err = <-serveErr:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer shutdownCancel()
+
+	err = server.Shutdown(shutdownCtx)
+
+	drained := make(chan struct{})
+
+	go func() {
+		s.stop()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Printf("Shutdown timeout reached with events still queued")
+		cancel()
+	}
+
+	return err
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codepipeline"
+	"github.com/google/go-github/github"
+)
+
+// how long an action may run before it is flagged, unless the repo config
+// says otherwise. Approvals wait on people, so they get a day.
+const defaultStuckAfter = time.Hour
+
+var defaultStuckAfterByCategory = map[string]time.Duration{
+	codepipeline.ActionCategoryApproval: 24 * time.Hour,
+}
+
+const stuckMarker = "exceeded expected"
+
+type runningAction struct {
+	stage       string
+	action      string
+	category    string
+	executionID string
+	elapsed     time.Duration
+	url         string
+}
+
+// STUCK_SCAN_PIPELINES limits the scan to a comma separated list of
+// pipelines, otherwise every pipeline in the account is scanned
+func getStuckScanPipelines() []string {
+	var pipelines []string
+
+	for _, name := range strings.Split(os.Getenv("STUCK_SCAN_PIPELINES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			pipelines = append(pipelines, name)
+		}
+	}
+
+	return pipelines
+}
+
+// the threshold for an action, looked up by action name, then by category
+func stuckThreshold(config *repoConfig, action, category string) time.Duration {
+	if threshold, ok := config.StuckAfter[action]; ok {
+		return threshold
+	}
+
+	if threshold, ok := config.StuckAfter[category]; ok {
+		return threshold
+	}
+
+	if threshold, ok := defaultStuckAfterByCategory[category]; ok {
+		return threshold
+	}
+
+	return defaultStuckAfter
+}
+
+// durations like 3h or 1h20m read better than 3h0m0s in a status
+func formatElapsed(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+
+	s := d.Round(time.Minute).String()
+	s = strings.TrimSuffix(s, "0s")
+
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+
+	return s
+}
+
+func stuckDescription(a runningAction, threshold time.Duration) string {
+	verb := "Running"
+	if a.category == codepipeline.ActionCategoryApproval {
+		verb = "Waiting for approval"
+	}
+
+	return fmt.Sprintf("%s for %s, %s %s", verb, formatElapsed(a.elapsed), stuckMarker, formatElapsed(threshold))
+}
+
+// actions that are in progress right now, with how long they have been
+// running. Source actions are the GitHub trigger and never block a commit.
+func runningActions(pipeline *codepipeline.PipelineDeclaration, state *codepipeline.GetPipelineStateOutput,
+	now time.Time) []runningAction {
+	categories := make(map[string]string)
+
+	for _, stage := range pipeline.Stages {
+		for _, action := range stage.Actions {
+			if action.ActionTypeId != nil {
+				categories[actionKey(aws.StringValue(stage.Name), aws.StringValue(action.Name))] =
+					aws.StringValue(action.ActionTypeId.Category)
+			}
+		}
+	}
+
+	var running []runningAction
+
+	for _, stage := range state.StageStates {
+		if stage.LatestExecution == nil {
+			continue
+		}
+
+		stageName := aws.StringValue(stage.StageName)
+
+		for _, action := range stage.ActionStates {
+			execution := action.LatestExecution
+			if execution == nil || aws.StringValue(execution.Status) != codepipeline.ActionExecutionStatusInProgress {
+				continue
+			}
+
+			category := categories[actionKey(stageName, aws.StringValue(action.ActionName))]
+			if category == codepipeline.ActionCategorySource {
+				continue
+			}
+
+			running = append(running, runningAction{
+				stage:       stageName,
+				action:      aws.StringValue(action.ActionName),
+				category:    category,
+				executionID: aws.StringValue(stage.LatestExecution.PipelineExecutionId),
+				// the last change of an action in progress is when it started
+				elapsed: now.Sub(aws.TimeValue(execution.LastStatusChange)),
+				url:     aws.StringValue(execution.ExternalExecutionUrl),
+			})
+		}
+	}
+
+	return running
+}
+
+func listPipelineNames(ctx context.Context) ([]string, error) {
+	svc := getAWSClients().codePipeline
+
+	var names []string
+
+	err := svc.ListPipelinesPagesWithContext(ctx, &codepipeline.ListPipelinesInput{},
+		func(page *codepipeline.ListPipelinesOutput, lastPage bool) bool {
+			for _, p := range page.Pipelines {
+				names = append(names, aws.StringValue(p.Name))
+			}
+
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pipelines: %s", err)
+	}
+
+	return names, nil
+}
+
+func scanPipeline(ctx context.Context, pipelineName, account, region string, now time.Time) error {
+	pipeline, err := getPipelineDeclaration(ctx, pipelineName)
+	if err != nil {
+		return err
+	}
+
+	state, err := getAWSClients().codePipeline.GetPipelineStateWithContext(ctx, &codepipeline.GetPipelineStateInput{
+		Name: aws.String(pipelineName),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to retrieve state of %s: %s", pipelineName, err)
+	}
+
+	for _, a := range runningActions(pipeline, state, now) {
+		details := executionDetails{pipelineName: pipelineName, executionID: a.executionID}
+
+		revision, err := getRevisionID(ctx, details)
+		if err != nil {
+			log.Printf("Skipping %s in %s: %s", a.action, a.executionID, err)
+			continue
+		}
+
+		gh, err := getGitHubClient(revision.host, revision.owner)
+		if err != nil {
+			log.Printf("Skipping %s in %s: %s", a.action, a.executionID, err)
+			continue
+		}
+
+		config := loadRepoConfig(ctx, gh, revision.owner, revision.repo, revision.commit)
+		threshold := stuckThreshold(&config, a.action, a.category)
+
+		if !config.Statuses || a.elapsed <= threshold {
+			continue
+		}
+
+		// the flagged status is what keeps notifications from repeating, so
+		// actions without a status are skipped entirely
+		target := pipelineTarget(ctx, pipelineName, account, region, revision.owner+"/"+revision.repo).
+			forAction(a.stage, a.action)
+		if !target.allows(routingRules, routeStatus) {
+			continue
+		}
+
+		err = flagStuckAction(ctx, gh, a, threshold, revision, executionTimelineURL(region, details), &config,
+			target.allows(routingRules, routeNotification))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the status stays pending since the action may still finish, the
+// description says why it has been pending for so long. Sinks only hear
+// about an action the first time it is flagged.
+func flagStuckAction(ctx context.Context, gh *github.Client, a runningAction, threshold time.Duration,
+	revision *revisionInfo, timelineURL string, config *repoConfig, notify bool) error {
+	status := statusInfo{
+		owner:       revision.owner,
+		repo:        revision.repo,
+		host:        revision.host,
+		commitID:    revision.commit,
+		label:       statusLabelFor(a.action, config),
+		stage:       a.stage,
+		action:      a.action,
+		state:       "pending",
+		description: stuckDescription(a, threshold),
+		url:         timelineURL,
+	}
+
+	if a.url != "" {
+		status.url = a.url
+	}
+
+	current, err := getCommitStatuses(ctx, gh, revision.owner, revision.repo, revision.commit)
+	if err != nil {
+		return err
+	}
+
+	flagged := false
+
+	for _, s := range current {
+		if s.GetContext() == status.label && strings.Contains(s.GetDescription(), stuckMarker) {
+			flagged = true
+		}
+	}
+
+	log.Printf("%s in %s is stuck: %s", a.action, a.executionID, status.description)
+
+	err = updateGitHubStatus(ctx, &status)
+	if err != nil {
+		return err
+	}
+
+	if flagged || !notify {
+		return nil
+	}
+
+	message := fmt.Sprintf("%s in %s/%s@%.7s: %s %s", a.action, revision.owner, revision.repo, revision.commit,
+		status.description, status.url)
+
+	for _, sink := range notificationSinks {
+		err = sink.notify(ctx, message)
+		if err != nil {
+			// the status is already flagged, a flaky webhook is not worth a retry
+			log.Printf("Error notifying about %s: %s", a.action, err)
+		}
+	}
+
+	return nil
+}
+
+// processScheduledEvent scans for stuck actions, run it from an EventBridge
+// schedule such as rate(15 minutes)
+func processScheduledEvent(ctx context.Context, request events.CloudWatchEvent) error {
+	pipelines := stuckScanPipelines
+	if len(pipelines) == 0 {
+		var err error
+
+		pipelines, err = listPipelineNames(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+
+	var firstErr error
+
+	// one broken pipeline should not hide stuck actions in the others
+	for _, pipelineName := range pipelines {
+		scanCtx, span := startSpan(ctx, "scan "+pipelineName, spanKindInternal)
+		span.set("codepipeline.pipeline", pipelineName)
+
+		err := scanPipeline(scanCtx, pipelineName, request.AccountID, request.Region, now)
+		span.finish(err)
+
+		if err != nil {
+			log.Printf("Error scanning %s for stuck actions: %s", pipelineName, err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the comment lists this many failures, the totals still count them all
+	maxListedFailures = 10
+
+	// long stack traces are cut, the log link has the rest
+	maxFailureLines = 15
+)
+
+type testFailure struct {
+	Name    string
+	Message string
+}
+
+type testTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// testReport is what the parsers found in one source, the runners found in
+// a log and the JUnit reports of a build are each added up
+type testReport struct {
+	passed   int
+	failed   int
+	skipped  int
+	failures []testFailure
+	timings  []testTiming
+	// counted from part of the log, the totals miss earlier tests
+	partial bool
+}
+
+func (r *testReport) add(other testReport) {
+	r.passed += other.passed
+	r.failed += other.failed
+	r.skipped += other.skipped
+	r.failures = append(r.failures, other.failures...)
+	r.timings = append(r.timings, other.timings...)
+	r.partial = r.partial || other.partial
+}
+
+func (r *testReport) total() int {
+	return r.passed + r.failed + r.skipped
+}
+
+// the leading lines of a failure message, with the blank lines dropped
+func trimFailureMessage(lines []string) string {
+	var kept []string
+
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if len(kept) == maxFailureLines {
+			kept = append(kept, "...")
+			break
+		}
+
+		kept = append(kept, strings.TrimRight(line, "\r"))
+	}
+
+	return strings.Join(kept, "\n")
+}
+
+// buildTestReport adds the log results of the runners the JUnit reports of
+// a build don't cover, builds that write reports usually print the same
+// tests to the log as well
+func buildTestReport(logBody string, truncated bool, junit testReport) testReport {
+	if junit.total() == 0 {
+		return parseTestOutput(logBody, truncated)
+	}
+
+	reported := make(map[string]bool)
+	for _, name := range junit.testNames() {
+		reported[lastNamePart(name)] = true
+	}
+
+	report := junit
+
+	for _, runner := range parseTestRunners(logBody, truncated) {
+		if !coveredByJUnit(runner, reported) {
+			report.add(runner)
+		}
+	}
+
+	return report
+}
+
+// parseTestOutput looks for every test runner the parsers know in a build
+// log, a build that runs go and jest tests gets both in its report
+func parseTestOutput(logBody string, truncated bool) testReport {
+	var report testReport
+
+	for _, runner := range parseTestRunners(logBody, truncated) {
+		report.add(runner)
+	}
+
+	return report
+}
+
+// one report per test runner found in a build log
+func parseTestRunners(logBody string, truncated bool) []testReport {
+	goTests := parseGoTestOutput(logBody)
+	goTests.add(parseGoTestJSON(logBody))
+
+	// go test prints no totals, tests before the retrieved tail are missing
+	goTests.partial = truncated && goTests.total() > 0
+
+	return []testReport{goTests, parsePytestOutput(logBody), parseJestOutput(logBody)}
+}
+
+func (r *testReport) testNames() []string {
+	names := make([]string, 0, len(r.timings)+len(r.failures))
+
+	for _, timing := range r.timings {
+		names = append(names, timing.name)
+	}
+
+	for _, failure := range r.failures {
+		names = append(names, failure.Name)
+	}
+
+	return names
+}
+
+// the log and the reports name tests differently, "TestParse" is
+// "pkg.TestParse" to go-junit-report and "tests/test_api.py::test_login" is
+// "tests.test_api.test_login" to pytest, so only the last part is compared
+func lastNamePart(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return strings.ContainsRune(".:/› ", r)
+	})
+	if len(parts) == 0 {
+		return name
+	}
+
+	return parts[len(parts)-1]
+}
+
+// a runner is covered when the reports name one of its tests, a runner that
+// printed only totals can't be told apart and the reports win
+func coveredByJUnit(runner testReport, reported map[string]bool) bool {
+	names := runner.testNames()
+	if len(names) == 0 {
+		return true
+	}
+
+	for _, name := range names {
+		if reported[lastNamePart(name)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func scanLines(logBody string, fn func(line string)) {
+	scanner := bufio.NewScanner(strings.NewReader(logBody))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+}
+
+func parseSeconds(s string) time.Duration {
+	seconds, _ := strconv.ParseFloat(strings.Replace(s, ",", "", -1), 64)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+var (
+	goTestRun    = regexp.MustCompile(`^=== (?:RUN|CONT|PAUSE)\s+(\S+)`)
+	goTestResult = regexp.MustCompile(`^\s*--- (PASS|FAIL|SKIP): (\S+) \(([\d.]+)s\)`)
+	goTestOutput = regexp.MustCompile(`^\s+\S`)
+)
+
+// go test -v prints a result line per test, the output of a test is
+// indented under its RUN line, or under the FAIL line in go before 1.14
+func parseGoTestOutput(logBody string) testReport {
+	var report testReport
+
+	output := make(map[string][]string)
+
+	var current string
+
+	scanLines(logBody, func(line string) {
+		if match := goTestRun.FindStringSubmatch(line); match != nil {
+			current = match[1]
+			return
+		}
+
+		match := goTestResult.FindStringSubmatch(line)
+		if match == nil {
+			if current != "" && goTestOutput.MatchString(line) {
+				output[current] = append(output[current], strings.TrimSpace(line))
+			}
+
+			return
+		}
+
+		name := match[2]
+		report.timings = append(report.timings, testTiming{name: name, duration: parseSeconds(match[3])})
+
+		switch match[1] {
+		case "PASS":
+			report.passed++
+			delete(output, name)
+		case "SKIP":
+			report.skipped++
+			delete(output, name)
+		case "FAIL":
+			report.failed++
+			report.failures = append(report.failures, testFailure{Name: name})
+		}
+
+		current = name
+	})
+
+	for i, failure := range report.failures {
+		report.failures[i].Message = trimFailureMessage(output[failure.Name])
+	}
+
+	report.failures = dropFailedParents(report.failures)
+
+	return report
+}
+
+// a test fails along with its failed subtests, the subtests say why
+func dropFailedParents(failures []testFailure) []testFailure {
+	var kept []testFailure
+
+	for _, failure := range failures {
+		parent := false
+
+		for _, other := range failures {
+			if strings.HasPrefix(other.Name, failure.Name+"/") {
+				parent = true
+				break
+			}
+		}
+
+		if !parent || failure.Message != "" {
+			kept = append(kept, failure)
+		}
+	}
+
+	return kept
+}
+
+type goTestEvent struct {
+	Action  string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// go test -json prints one event per line
+func parseGoTestJSON(logBody string) testReport {
+	var report testReport
+
+	output := make(map[string][]string)
+
+	scanLines(logBody, func(line string) {
+		if !strings.HasPrefix(line, "{") || !strings.Contains(line, `"Action"`) {
+			return
+		}
+
+		var event goTestEvent
+		if json.Unmarshal([]byte(line), &event) != nil || event.Test == "" {
+			return
+		}
+
+		switch event.Action {
+		case "output":
+			text := strings.TrimRight(event.Output, "\n")
+			if !goTestRun.MatchString(text) && !goTestResult.MatchString(text) {
+				output[event.Test] = append(output[event.Test], strings.TrimSpace(text))
+			}
+
+			return
+		case "pass":
+			report.passed++
+		case "skip":
+			report.skipped++
+		case "fail":
+			report.failed++
+			report.failures = append(report.failures, testFailure{
+				Name:    event.Test,
+				Message: trimFailureMessage(output[event.Test]),
+			})
+		default:
+			return
+		}
+
+		report.timings = append(report.timings, testTiming{
+			name:     event.Test,
+			duration: time.Duration(event.Elapsed * float64(time.Second)),
+		})
+	})
+
+	report.failures = dropFailedParents(report.failures)
+
+	return report
+}
+
+var (
+	pytestSummary  = regexp.MustCompile(`^=+ (.*\d+ (?:passed|failed|skipped|errors?).*) in [\d.]+s.*=+$`)
+	pytestCount    = regexp.MustCompile(`(\d+) (passed|failed|skipped|errors?|xfailed|xpassed)`)
+	pytestFailure  = regexp.MustCompile(`^(?:FAILED|ERROR) (\S+)(?: - (.*))?$`)
+	pytestDuration = regexp.MustCompile(`^([\d.]+)s call\s+(\S+)$`)
+)
+
+// pytest ends with a summary line, the short test summary lists the failures
+// and --durations lists the slowest tests
+func parsePytestOutput(logBody string) testReport {
+	var report testReport
+
+	scanLines(logBody, func(line string) {
+		if match := pytestSummary.FindStringSubmatch(line); match != nil {
+			for _, count := range pytestCount.FindAllStringSubmatch(match[1], -1) {
+				n, _ := strconv.Atoi(count[1])
+
+				switch count[2] {
+				case "passed", "xpassed":
+					report.passed += n
+				case "failed", "error", "errors":
+					report.failed += n
+				case "skipped", "xfailed":
+					report.skipped += n
+				}
+			}
+
+			return
+		}
+
+		if match := pytestFailure.FindStringSubmatch(line); match != nil {
+			report.failures = append(report.failures, testFailure{Name: match[1], Message: match[2]})
+			return
+		}
+
+		if match := pytestDuration.FindStringSubmatch(line); match != nil {
+			report.timings = append(report.timings, testTiming{name: match[2], duration: parseSeconds(match[1])})
+		}
+	})
+
+	return report
+}
+
+var (
+	jestTotals  = regexp.MustCompile(`^Tests:\s+(.*\d+ total)\s*$`)
+	jestCount   = regexp.MustCompile(`(\d+) (passed|failed|skipped|todo)`)
+	jestFailure = regexp.MustCompile(`^\s*● (.+)$`)
+	jestConsole = regexp.MustCompile(`^\s*● Console\s*$`)
+	// the summary repeats every failure block after the totals of each suite
+	jestFailureSummary = regexp.MustCompile(`^Summary of all failing tests\s*$`)
+	jestTiming         = regexp.MustCompile(`^\s*[✓✕√×] (.+) \((\d+) ms\)$`)
+	jestSummary        = regexp.MustCompile(`^(?:Test Suites|Tests|Snapshots|Time):`)
+)
+
+// jest prints a block per failure under a ● heading and totals at the end,
+// --verbose adds the duration of slower tests
+func parseJestOutput(logBody string) testReport {
+	var report testReport
+
+	var failure *testFailure
+
+	var message []string
+
+	inSummary := false
+
+	endFailure := func() {
+		if failure != nil {
+			failure.Message = trimFailureMessage(message)
+			report.failures = append(report.failures, *failure)
+			failure, message = nil, nil
+		}
+	}
+
+	scanLines(logBody, func(line string) {
+		if match := jestTotals.FindStringSubmatch(line); match != nil {
+			endFailure()
+
+			for _, count := range jestCount.FindAllStringSubmatch(match[1], -1) {
+				n, _ := strconv.Atoi(count[1])
+
+				switch count[2] {
+				case "passed":
+					report.passed += n
+				case "failed":
+					report.failed += n
+				case "skipped", "todo":
+					report.skipped += n
+				}
+			}
+
+			inSummary = false
+
+			return
+		}
+
+		if jestFailureSummary.MatchString(line) {
+			endFailure()
+
+			inSummary = true
+
+			return
+		}
+
+		if match := jestFailure.FindStringSubmatch(line); match != nil {
+			endFailure()
+
+			// console output is not a failure, its lines are left out with it
+			if !inSummary && !jestConsole.MatchString(line) {
+				failure = &testFailure{Name: match[1]}
+			}
+
+			return
+		}
+
+		if match := jestTiming.FindStringSubmatch(line); match != nil {
+			endFailure()
+
+			ms, _ := strconv.Atoi(match[2])
+			report.timings = append(report.timings, testTiming{name: match[1], duration: time.Duration(ms) * time.Millisecond})
+
+			return
+		}
+
+		if jestSummary.MatchString(line) {
+			endFailure()
+			return
+		}
+
+		if failure != nil {
+			message = append(message, strings.TrimSpace(line))
+		}
+	})
+
+	endFailure()
+
+	return report
+}
+
+// testReportView is what the comment template shows, nil without tests
+type testReportView struct {
+	Totals   string
+	Failures []testFailure
+	Slowest  string
+}
+
+func formatTestReport(report testReport, slowest int, config *repoConfig) *testReportView {
+	if report.total() == 0 && len(report.failures) == 0 {
+		return nil
+	}
+
+	view := &testReportView{
+		Totals: fmt.Sprintf("**Tests:** %d passed, %d failed, %d skipped", report.passed, report.failed, report.skipped),
+	}
+
+	if report.partial {
+		view.Totals += ", go tests counted from the retrieved lines only"
+	}
+
+	failures := report.failures
+	if len(failures) > maxListedFailures {
+		view.Totals += fmt.Sprintf(", showing the first %d failures", maxListedFailures)
+		failures = failures[:maxListedFailures]
+	}
+
+	for _, failure := range failures {
+		// JUnit reports never went through the log redaction
+		view.Failures = append(view.Failures, testFailure{
+			Name:    config.redact(failure.Name),
+			Message: config.redact(failure.Message),
+		})
+	}
+
+	timings := append([]testTiming(nil), report.timings...)
+	sort.SliceStable(timings, func(i, j int) bool { return timings[i].duration > timings[j].duration })
+
+	if len(timings) > slowest {
+		timings = timings[:slowest]
+	}
+
+	if len(timings) > 0 {
+		var table strings.Builder
+
+		table.WriteString("| Slowest tests | Duration |\n")
+		table.WriteString("|---------------|----------|\n")
+
+		for _, timing := range timings {
+			fmt.Fprintf(&table, "| %s | %s |\n", escapeTableCell(config.redact(timing.name)),
+				timing.duration.Round(time.Millisecond))
+		}
+
+		view.Slowest = table.String()
+	}
+
+	return view
+}
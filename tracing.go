@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// span kinds and status codes from the OTLP trace protocol
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// span is an OpenTelemetry span, exported over OTLP/HTTP as JSON so tracing
+// works without pulling the OpenTelemetry SDK into the lambda
+type span struct {
+	tracer   *spanExporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+type spanContextKey struct{}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child of the span in ctx, or a new trace. The span is
+// nil when tracing is off, which every method accepts.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if parent := spanFromContext(ctx); parent != nil {
+		return parent.tracer.start(ctx, name, kind)
+	}
+
+	return tracer.start(ctx, name, kind)
+}
+
+func (t *spanExporter) start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+
+	_, _ = rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// set an attribute, values are strings, ints or bools
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	s.tracer.finished = append(s.tracer.finished, s)
+	s.tracer.mu.Unlock()
+}
+
+// spanExporter collects finished spans and posts them to an OTLP collector
+// at the end of each invocation, a frozen lambda can't export in the
+// background
+type spanExporter struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+
+	mu       sync.Mutex
+	finished []*span
+}
+
+// nil unless an OTLP endpoint is configured, which turns tracing off
+var tracer *spanExporter
+
+// the standard OpenTelemetry exporter variables, OTEL_EXPORTER_OTLP_ENDPOINT
+// is the collector base URL, e.g. http://localhost:4318
+func getTracer() *spanExporter {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	headers := make(map[string]string)
+
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) == 2 {
+			headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "pipeline-monitor"
+	}
+
+	return &spanExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	result := make([]otlpAttribute, 0, len(keys))
+
+	for _, key := range keys {
+		var value map[string]interface{}
+
+		switch v := attributes[key].(type) {
+		case int:
+			// 64 bit integers are strings in the JSON encoding of OTLP
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+
+		result = append(result, otlpAttribute{Key: key, Value: value})
+	}
+
+	return result
+}
+
+func (s *span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	encoded := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+
+	if s.parentID != [8]byte{} {
+		encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+
+	if s.err != nil {
+		encoded["status"] = map[string]interface{}{"code": spanStatusError, "message": s.err.Error()}
+	}
+
+	return encoded
+}
+
+// exportRequest is the body of an OTLP/HTTP trace export
+func (t *spanExporter) exportRequest(spans []*span) ([]byte, error) {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		encoded = append(encoded, s.otlp())
+	}
+
+	resource := map[string]interface{}{
+		"service.name":   t.service,
+		"cloud.provider": "aws",
+	}
+
+	if lambdacontext.FunctionName != "" {
+		resource["faas.name"] = lambdacontext.FunctionName
+		resource["faas.version"] = lambdacontext.FunctionVersion
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "pipeline-monitor"},
+				"spans": encoded,
+			}},
+		}},
+	})
+}
+
+func (t *spanExporter) flush() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	spans := t.finished
+	t.finished = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	err := t.export(spans)
+	if err != nil {
+		// traces are diagnostics, they never fail an event
+		log.Printf("Unable to export %d spans: %s", len(spans), err)
+	}
+}
+
+func (t *spanExporter) export(spans []*span) error {
+	body, err := t.exportRequest(spans)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", t.endpoint, resp.Status)
+	}
+
+	return nil
+}
+
+// the root span of a Lambda invocation
+func startInvocationSpan(ctx context.Context) (context.Context, *span) {
+	name := lambdacontext.FunctionName
+	if name == "" {
+		name = "pipeline-monitor"
+	}
+
+	ctx, s := startSpan(ctx, name, spanKindServer)
+
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		s.set("faas.invocation_id", lc.AwsRequestID)
+	}
+
+	return ctx, s
+}
+
+// tracingTransport wraps GitHub API calls in client spans
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, s := startSpan(req.Context(), "GitHub "+req.Method, spanKindClient)
+	s.set("http.method", req.Method)
+	s.set("http.url", req.URL.String())
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		s.set("http.status_code", resp.StatusCode)
+
+		if resp.StatusCode >= 400 {
+			s.set("error", true)
+		}
+	}
+
+	s.finish(err)
+
+	return resp, err
+}
+
+// traceAWSRequests adds client spans to every request made by clients of a
+// session. Requests without a context start their own trace.
+func traceAWSRequests(handlers *request.Handlers) {
+	handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "pipeline-monitor.StartSpan",
+		Fn: func(r *request.Request) {
+			if r.IsPresigned() {
+				return
+			}
+
+			ctx, s := startSpan(r.Context(), r.ClientInfo.ServiceName+"."+r.Operation.Name, spanKindClient)
+			s.set("rpc.system", "aws-api")
+			s.set("rpc.service", r.ClientInfo.ServiceName)
+			s.set("rpc.method", r.Operation.Name)
+
+			if s != nil {
+				r.SetContext(ctx)
+			}
+		},
+	})
+
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "pipeline-monitor.FinishSpan",
+		Fn: func(r *request.Request) {
+			// a request that failed validation never started its span, the one
+			// in its context then belongs to the caller
+			s := spanFromContext(r.Context())
+			if s == nil || s.name != r.ClientInfo.ServiceName+"."+r.Operation.Name {
+				return
+			}
+
+			s.set("aws.request_id", r.RequestID)
+			s.set("aws.retries", r.RetryCount)
+
+			if r.HTTPResponse != nil {
+				s.set("http.status_code", r.HTTPResponse.StatusCode)
+			}
+
+			s.finish(r.Error)
+		},
+	})
+}
+
+// annotate the span of an event with the pipeline execution it is about
+func tracePipeline(ctx context.Context, details executionDetails) {
+	s := spanFromContext(ctx)
+	s.set("codepipeline.pipeline", details.pipelineName)
+	s.set("codepipeline.execution_id", details.executionID)
+}
+
+// annotate the span of an event with the commit it reports on
+func traceRevision(ctx context.Context, host, owner, repo, commit string) {
+	s := spanFromContext(ctx)
+	s.set("github.host", host)
+	s.set("github.repo", owner+"/"+repo)
+	s.set("github.commit", commit)
+}
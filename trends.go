@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codebuild"
+	"github.com/google/go-github/github"
+)
+
+// phases shorter than this are too noisy to flag, a 2s phase taking 4s is
+// not a regression anyone cares about
+const minRegression = 30 * time.Second
+
+type durationComparison struct {
+	name      string
+	current   time.Duration
+	median    time.Duration
+	regressed bool
+}
+
+type buildTrend struct {
+	baselineBuilds int
+	total          durationComparison
+	phases         []durationComparison
+	// durations of the baseline builds oldest first, followed by this build
+	history []time.Duration
+}
+
+func medianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
+
+func compareDuration(name string, current time.Duration, baseline []time.Duration,
+	thresholdPercent int) durationComparison {
+	median := medianDuration(baseline)
+	limit := median + median*time.Duration(thresholdPercent)/100
+
+	return durationComparison{
+		name:      name,
+		current:   current,
+		median:    median,
+		regressed: len(baseline) > 0 && current > limit && current-median >= minRegression,
+	}
+}
+
+// compare a build against the most recent successful builds, baseline is
+// ordered newest first the same way ListBuildsForProject returns it
+func compareBuildDurations(current buildSummary, baseline []buildSummary, thresholdPercent int) buildTrend {
+	trend := buildTrend{baselineBuilds: len(baseline)}
+
+	var totals []time.Duration
+
+	phaseDurations := make(map[string][]time.Duration)
+
+	for i := len(baseline) - 1; i >= 0; i-- {
+		totals = append(totals, baseline[i].duration)
+
+		for _, p := range baseline[i].phases {
+			phaseDurations[p.name] = append(phaseDurations[p.name], p.duration)
+		}
+	}
+
+	trend.history = append(append(trend.history, totals...), current.duration)
+	trend.total = compareDuration("Total", current.duration, totals, thresholdPercent)
+
+	for _, p := range current.phases {
+		if p.duration == 0 {
+			continue
+		}
+
+		trend.phases = append(trend.phases, compareDuration(p.name, p.duration, phaseDurations[p.name], thresholdPercent))
+	}
+
+	return trend
+}
+
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+func sparkline(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return ""
+	}
+
+	low, high := durations[0], durations[0]
+
+	for _, d := range durations {
+		if d < low {
+			low = d
+		}
+
+		if d > high {
+			high = d
+		}
+	}
+
+	var line strings.Builder
+
+	for _, d := range durations {
+		bar := 0
+		if high > low {
+			bar = int((d - low) * time.Duration(len(sparkBars)-1) / (high - low))
+		}
+
+		line.WriteRune(sparkBars[bar])
+	}
+
+	return line.String()
+}
+
+func formatChange(c durationComparison) string {
+	if c.median == 0 {
+		return "-"
+	}
+
+	change := fmt.Sprintf("%+.0f%%", float64(c.current-c.median)*100/float64(c.median))
+	if c.regressed {
+		change += " :warning:"
+	}
+
+	return change
+}
+
+func formatBuildTrend(trend *buildTrend) string {
+	if trend == nil || trend.baselineBuilds == 0 {
+		return ""
+	}
+
+	var table strings.Builder
+
+	fmt.Fprintf(&table, "**Duration trend** compared with the median of the last %d successful base branch builds: %s\n\n",
+		trend.baselineBuilds, sparkline(trend.history))
+	table.WriteString("| Phase | This build | Median | Change |\n")
+	table.WriteString("|-------|------------|--------|--------|\n")
+
+	for _, c := range append([]durationComparison{trend.total}, trend.phases...) {
+		fmt.Fprintf(&table, "| %s | %s | %s | %s |\n", c.name, c.current, c.median, formatChange(c))
+	}
+
+	return table.String()
+}
+
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// manual and scheduled builds of the base branch report the branch as the
+// source version, builds started from a commit hash could be of any branch
+func isBaseBranchBuild(sourceVersion, baseRef string) bool {
+	switch sourceVersion {
+	case baseRef, "refs/heads/" + baseRef:
+		return true
+	}
+
+	return false
+}
+
+// builds started by a push webhook report the commit hash as the source
+// version, they count when the commit is on the base branch
+func isCommitOnBranch(ctx context.Context, gh *github.Client, owner, repo, commit, baseRef string) bool {
+	comparison, _, err := gh.Repositories.CompareCommits(ctx, owner, repo, baseRef, commit)
+	if err != nil {
+		log.Printf("Unable to compare %s with %s in %s/%s: %s", commit, baseRef, owner, repo, err)
+		return false
+	}
+
+	switch comparison.GetStatus() {
+	case "identical", "behind":
+		return true
+	}
+
+	return false
+}
+
+// a page of the most recent builds of a project newest first, and the token
+// of the next page. The trend and the cost estimate share the first page.
+func listRecentBuilds(ctx context.Context, projectName, excludeID string,
+	token *string) ([]*codebuild.Build, *string, error) {
+	svc := getAWSClients().codeBuild
+
+	list, err := svc.ListBuildsForProjectWithContext(ctx, &codebuild.ListBuildsForProjectInput{
+		ProjectName: aws.String(projectName),
+		SortOrder:   aws.String(codebuild.SortOrderTypeDescending),
+		NextToken:   token,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to list builds for %s: %s", projectName, err)
+	}
+
+	var ids []*string
+
+	for _, id := range list.Ids {
+		if aws.StringValue(id) != excludeID {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, list.NextToken, nil
+	}
+
+	// a single page of ListBuildsForProject fits in one BatchGetBuilds call
+	result, err := svc.BatchGetBuildsWithContext(ctx, &codebuild.BatchGetBuildsInput{Ids: ids})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get recent builds for %s: %s", projectName, err)
+	}
+
+	builds := result.Builds
+	sort.Slice(builds, func(i, j int) bool {
+		return aws.TimeValue(builds[i].StartTime).After(aws.TimeValue(builds[j].StartTime))
+	})
+
+	return builds, list.NextToken, nil
+}
+
+// trends are a nice to have, failing to compute one is logged and the
+// comment is posted without it
+func addBuildTrend(ctx context.Context, gh *github.Client, details *buildDetails, config *repoConfig,
+	recent []*codebuild.Build) {
+	if config.TrendBuilds <= 0 {
+		return
+	}
+
+	pr, _, err := gh.PullRequests.Get(ctx, details.owner, details.repo, details.prID)
+	if err != nil {
+		log.Printf("Unable to find base branch of %s/%s#%d: %s", details.owner, details.repo, details.prID, err)
+		return
+	}
+
+	baseRef := pr.GetBase().GetRef()
+
+	var baseline []buildSummary
+
+	for _, build := range recent {
+		if len(baseline) == config.TrendBuilds {
+			break
+		}
+
+		if aws.StringValue(build.BuildStatus) != codebuild.StatusTypeSucceeded {
+			continue
+		}
+
+		sourceVersion := aws.StringValue(build.SourceVersion)
+		if !isBaseBranchBuild(sourceVersion, baseRef) && (!commitSHA.MatchString(sourceVersion) ||
+			!isCommitOnBranch(ctx, gh, details.owner, details.repo, sourceVersion, baseRef)) {
+			continue
+		}
+
+		baseline = append(baseline, summarizeBuild(build))
+	}
+
+	trend := compareBuildDurations(details.summary, baseline, config.TrendThresholdPercent)
+	details.trend = &trend
+}